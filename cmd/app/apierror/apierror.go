@@ -0,0 +1,193 @@
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+)
+
+// error codes, every error response carries one of them
+const (
+	CodeBadRequest         = "bad_request"
+	CodeValidation         = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeConflict           = "conflict"
+	CodePreconditionFailed = "precondition_failed"
+	CodePreconditionNeeded = "precondition_required"
+	CodeUnsupportedMedia   = "unsupported_media_type"
+	CodePayloadTooLarge    = "payload_too_large"
+	CodeTooManyRequests    = "too_many_requests"
+	CodeInternal           = "internal_error"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeInvalidToken       = "invalid_token"
+	CodeTokenExpired       = "token_expired"
+	CodeTokenReused        = "token_reused"
+	CodeInvalidPassword    = "invalid_password"
+	CodeWeakPassword       = "weak_password"
+	CodeInvalidCode        = "invalid_code"
+	CodeInvalidTOTP        = "invalid_totp"
+	CodeTOTPEnabled        = "totp_enabled"
+	CodeBasicNotAllowed    = "basic_not_allowed"
+	CodeInvalidScope       = "invalid_scope"
+	CodeInvalidAllowlist   = "invalid_allowlist"
+	CodeAddressNotAllowed  = "address_not_allowed"
+	CodeInsufficientStock  = "insufficient_stock"
+	CodePriceOverride      = "price_override_forbidden"
+	CodeNoOverrideReason   = "override_reason_required"
+	CodeInvalidSort        = "invalid_sort"
+	CodeInvalidCursor      = "invalid_cursor"
+)
+
+// field error codes, validate reports them and the password policy adds its own rules
+const (
+	CodeRequired     = "required"
+	CodeTooShort     = "too_short"
+	CodeTooLong      = "too_long"
+	CodeTooSmall     = "too_small"
+	CodeTooLarge     = "too_large"
+	CodeNotPositive  = "not_positive"
+	CodeInvalidPhone = "invalid_phone"
+	CodeNotAllowed   = "not_allowed"
+	CodeUnknownField = "unknown_field"
+	CodeInvalidType  = "invalid_type"
+)
+
+//FieldError points at one invalid input field
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//Error is the body of every error response
+type Error struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Fields    []FieldError           `json:"fields,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+//CodeForStatus is the generic code of a status, for errors nothing more is known about
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusPreconditionFailed:
+		return CodePreconditionFailed
+	case http.StatusPreconditionRequired:
+		return CodePreconditionNeeded
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMedia
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+//Write answers with an error body, messages are localized by Accept-Language;
+//r may be nil when no request is at hand
+func Write(w http.ResponseWriter, r *http.Request, status int, body *Error) {
+	lang := DefaultLanguage
+	logger := logging.FromContext(context.Background())
+	if r != nil {
+		lang = Language(r)
+		body.RequestID = logging.RequestID(r.Context())
+		logger = logging.FromContext(r.Context())
+	}
+	if body.Message == "" {
+		body.Message = Message(lang, body.Code)
+	}
+	for i := range body.Fields {
+		if body.Fields[i].Message == "" {
+			body.Fields[i].Message = Message(lang, body.Fields[i].Code)
+		}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		logger.Println(err)
+		data = []byte(`{"code":"` + CodeInternal + `"}`)
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	if err != nil {
+		logger.Println(err)
+	}
+}
+
+//WriteStatus answers with the generic error of status
+func WriteStatus(w http.ResponseWriter, r *http.Request, status int) {
+	Write(w, r, status, &Error{Code: CodeForStatus(status)})
+}
+
+//Language picks the best supported language from Accept-Language
+func Language(r *http.Request) string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var items []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.SplitN(fields[0], "-", 2)[0])
+		if _, ok := messages[lang]; !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if q > 0 {
+			items = append(items, weighted{lang: lang, q: q})
+		}
+	}
+	if len(items) == 0 {
+		return DefaultLanguage
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].q > items[j].q
+	})
+	return items[0].lang
+}
+
+//Message returns the text of code in lang, falling back to English and then to the code itself
+func Message(lang string, code string) string {
+	if text, ok := messages[lang][code]; ok {
+		return text
+	}
+	if text, ok := messages[DefaultLanguage][code]; ok {
+		return text
+	}
+	return code
+}
@@ -0,0 +1,104 @@
+package apierror
+
+import "github.com/SsSJKK/crud/pkg/security"
+
+// DefaultLanguage ...
+const DefaultLanguage = "en"
+
+// messages holds the texts of error and field codes per language
+var messages = map[string]map[string]string{
+	"en": {
+		CodeBadRequest:         "The request is malformed.",
+		CodeValidation:         "Some fields are invalid.",
+		CodeUnauthorized:       "Authentication is required.",
+		CodeForbidden:          "You are not allowed to do this.",
+		CodeNotFound:           "Not found.",
+		CodeMethodNotAllowed:   "Method not allowed.",
+		CodeConflict:           "The request conflicts with the current state.",
+		CodePreconditionFailed: "The resource was changed since you read it, fetch it again.",
+		CodePreconditionNeeded: "Send If-Match with the ETag of the resource.",
+		CodeUnsupportedMedia:   "Unsupported content type.",
+		CodePayloadTooLarge:    "The request body is too large.",
+		CodeTooManyRequests:    "Too many requests, try again later.",
+		CodeInternal:           "Internal error.",
+		CodeInvalidCredentials: "Invalid phone or password.",
+		CodeInvalidToken:       "The token is invalid.",
+		CodeTokenExpired:       "The token has expired.",
+		CodeTokenReused:        "The refresh token was already used, all sessions of its family are revoked.",
+		CodeInvalidPassword:    "The password is wrong.",
+		CodeWeakPassword:       "The password does not meet the password policy.",
+		CodeInvalidCode:        "The code is invalid or expired.",
+		CodeInvalidTOTP:        "The two-factor code is invalid.",
+		CodeTOTPEnabled:        "Two-factor authentication is already enabled.",
+		CodeBasicNotAllowed:    "Basic authentication is not allowed for this account.",
+		CodeInvalidScope:       "Unknown API key scope.",
+		CodeInvalidAllowlist:   "Invalid IP allowlist entry.",
+		CodeAddressNotAllowed:  "This address is not allowed for the API key.",
+		CodeInsufficientStock:  "Not enough products in stock.",
+		CodePriceOverride:      "You are not allowed to change prices.",
+		CodeNoOverrideReason:   "A reason is required to change a price.",
+		CodeInvalidSort:        "The listing cannot be sorted by this field.",
+		CodeInvalidCursor:      "The cursor is invalid or belongs to another sort order.",
+
+		security.RuleMinLength:   "The password is too short.",
+		security.RuleCommon:      "The password is too common.",
+		security.RuleEqualsPhone: "The password must not be the phone number.",
+		CodeRequired:             "This field is required.",
+		CodeTooShort:             "The value is too short.",
+		CodeTooLong:              "The value is too long.",
+		CodeTooSmall:             "The value is too small.",
+		CodeTooLarge:             "The value is too large.",
+		CodeNotPositive:          "The value must be positive.",
+		CodeInvalidPhone:         "The phone number is invalid.",
+		CodeNotAllowed:           "The value is not allowed.",
+		CodeUnknownField:         "Unknown field.",
+		CodeInvalidType:          "The value has a wrong type.",
+	},
+	"ru": {
+		CodeBadRequest:         "Некорректный запрос.",
+		CodeValidation:         "Некоторые поля заполнены неверно.",
+		CodeUnauthorized:       "Требуется авторизация.",
+		CodeForbidden:          "Недостаточно прав.",
+		CodeNotFound:           "Не найдено.",
+		CodeMethodNotAllowed:   "Метод не поддерживается.",
+		CodeConflict:           "Запрос конфликтует с текущим состоянием.",
+		CodePreconditionFailed: "Ресурс изменился с момента чтения, загрузите его заново.",
+		CodePreconditionNeeded: "Передайте If-Match с ETag ресурса.",
+		CodeUnsupportedMedia:   "Неподдерживаемый тип содержимого.",
+		CodePayloadTooLarge:    "Слишком большое тело запроса.",
+		CodeTooManyRequests:    "Слишком много запросов, попробуйте позже.",
+		CodeInternal:           "Внутренняя ошибка.",
+		CodeInvalidCredentials: "Неверный телефон или пароль.",
+		CodeInvalidToken:       "Недействительный токен.",
+		CodeTokenExpired:       "Срок действия токена истёк.",
+		CodeTokenReused:        "Токен обновления уже использован, все сессии этой цепочки отозваны.",
+		CodeInvalidPassword:    "Неверный пароль.",
+		CodeWeakPassword:       "Пароль не соответствует требованиям.",
+		CodeInvalidCode:        "Код неверный или устарел.",
+		CodeInvalidTOTP:        "Неверный код двухфакторной аутентификации.",
+		CodeTOTPEnabled:        "Двухфакторная аутентификация уже включена.",
+		CodeBasicNotAllowed:    "Basic-аутентификация для этой учётной записи запрещена.",
+		CodeInvalidScope:       "Неизвестная область доступа API-ключа.",
+		CodeInvalidAllowlist:   "Неверный адрес в списке разрешённых IP.",
+		CodeAddressNotAllowed:  "С этого адреса API-ключ использовать нельзя.",
+		CodeInsufficientStock:  "Недостаточно товара на складе.",
+		CodePriceOverride:      "Недостаточно прав для изменения цены.",
+		CodeNoOverrideReason:   "Для изменения цены нужно указать причину.",
+		CodeInvalidSort:        "По этому полю нельзя сортировать список.",
+		CodeInvalidCursor:      "Курсор неверный или относится к другой сортировке.",
+
+		security.RuleMinLength:   "Пароль слишком короткий.",
+		security.RuleCommon:      "Пароль слишком распространён.",
+		security.RuleEqualsPhone: "Пароль не должен совпадать с номером телефона.",
+		CodeRequired:             "Обязательное поле.",
+		CodeTooShort:             "Слишком короткое значение.",
+		CodeTooLong:              "Слишком длинное значение.",
+		CodeTooSmall:             "Слишком маленькое значение.",
+		CodeTooLarge:             "Слишком большое значение.",
+		CodeNotPositive:          "Значение должно быть положительным.",
+		CodeInvalidPhone:         "Неверный номер телефона.",
+		CodeNotAllowed:           "Недопустимое значение.",
+		CodeUnknownField:         "Неизвестное поле.",
+		CodeInvalidType:          "Неверный тип значения.",
+	},
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SsSJKK/crud/cmd/app/middleware"
+	"github.com/SsSJKK/crud/pkg/audit"
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/SsSJKK/crud/pkg/security"
+	"github.com/gorilla/mux"
+)
+
+// audited records an audit event for every call of handler; the outcome is taken
+// from the response status, handlers may fill in the target via audit.FromContext
+func (s *Server) audited(action string, kind string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientFromRequest(r)
+		event := &audit.Event{
+			ActorKind: kind,
+			Action:    action,
+			Target:    mux.Vars(r)["id"],
+			IP:        client.IP,
+			UserAgent: client.UserAgent,
+		}
+		if id, err := middleware.Authentication(r.Context()); err == nil {
+			event.ActorID = &id
+		}
+		if _, ok := middleware.Scopes(r.Context()); ok {
+			event.ActorKind = audit.KindAPIKey
+		}
+
+		recorder := &middleware.StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+		handler(recorder, r.WithContext(audit.WithEvent(r.Context(), event)))
+
+		// a handler may have settled the outcome itself, e.g. a login waiting for 2FA
+		if event.Outcome == "" {
+			event.Outcome = audit.OutcomeSuccess
+		}
+		if recorder.Status >= http.StatusBadRequest {
+			event.Outcome = audit.OutcomeFailure
+		}
+		s.recordEvent(r, event)
+	}
+}
+
+// auditTimeout bounds recording an event once the request is done
+const auditTimeout = 5 * time.Second
+
+// recordEvent records event even when the client is already gone: the action it
+// describes has happened, so it runs on a context of its own
+func (s *Server) recordEvent(r *http.Request, event *audit.Event) {
+	ctx := context.Background()
+	if id := logging.RequestID(r.Context()); id != "" {
+		ctx = logging.WithRequestID(ctx, id)
+	}
+	ctx, cancel := context.WithTimeout(ctx, auditTimeout)
+	defer cancel()
+	err := s.auditSvc.Record(ctx, event)
+	if err != nil {
+		logging.FromContext(ctx).Printf("audit event %s %s of %s lost: %v", event.Action, event.Outcome, event.ActorKind, err)
+	}
+}
+
+// auditedAuth records the requests that authentication turns away, API keys are told
+// apart by their prefix
+func (s *Server) auditedAuth(kind string) func(http.Handler) http.Handler {
+	return middleware.OnAuthFailure(func(r *http.Request) {
+		client := clientFromRequest(r)
+		event := &audit.Event{
+			ActorKind: kind,
+			Action:    "authenticate",
+			IP:        client.IP,
+			UserAgent: client.UserAgent,
+			Outcome:   audit.OutcomeFailure,
+		}
+		if strings.HasPrefix(r.Header.Get("Authorization"), security.APIKeyPrefix) {
+			event.ActorKind = audit.KindAPIKey
+		}
+		s.recordEvent(r, event)
+	})
+}
+
+func auditFilter(r *http.Request) (*audit.Filter, error) {
+	query := r.URL.Query()
+	filter := &audit.Filter{
+		ActorKind: query.Get("actor_kind"),
+		Action:    query.Get("action"),
+		Outcome:   query.Get("outcome"),
+	}
+	if value := query.Get("actor_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		filter.ActorID = &id
+	}
+	if value := query.Get("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+		filter.From = &from
+	}
+	if value := query.Get("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, err
+		}
+		filter.To = &to
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		filter.Offset = offset
+	}
+	return filter, nil
+}
+
+func (s *Server) hGetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	page, err := s.auditSvc.Events(r.Context(), filter)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, page)
+}
+
+func (s *Server) hExportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := auditFilter(r)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit_events.csv"`)
+	writer := csv.NewWriter(w)
+	err = writer.Write([]string{"id", "created", "actor_id", "actor_kind", "action", "target", "ip", "user_agent", "outcome"})
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	err = s.auditSvc.Export(r.Context(), filter, func(event *audit.Event) error {
+		actor := ""
+		if event.ActorID != nil {
+			actor = strconv.FormatInt(*event.ActorID, 10)
+		}
+		return writer.Write([]string{
+			strconv.FormatInt(event.ID, 10),
+			event.Created.Format(time.RFC3339),
+			actor,
+			csvCell(event.ActorKind),
+			csvCell(event.Action),
+			csvCell(event.Target),
+			csvCell(event.IP),
+			csvCell(event.UserAgent),
+			csvCell(event.Outcome),
+		})
+	})
+	writer.Flush()
+	if err == nil {
+		err = writer.Error()
+	}
+	if err != nil {
+		// headers are already sent, the best we can do is to cut the file short
+		logging.FromContext(r.Context()).Println(err)
+	}
+}
+
+// csvCell keeps spreadsheets from running a cell as a formula: cells starting
+// with one of = + - @ tab or carriage return get a leading '
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/SsSJKK/crud/pkg/audit"
+	"github.com/SsSJKK/crud/pkg/security"
+)
+
+func TestAuditedAuthRecordsRejectedRequests(t *testing.T) {
+	tests := []struct {
+		path string
+		auth string
+		want []*audit.Event
+	}{
+		{"/api/customers/me", "customer", nil},
+		{"/api/customers/me", "wrong", []*audit.Event{{ActorKind: audit.KindCustomer, Action: "authenticate", Outcome: audit.OutcomeFailure}}},
+		{"/api/managers/me", "wrong", []*audit.Event{{ActorKind: audit.KindManager, Action: "authenticate", Outcome: audit.OutcomeFailure}}},
+		{"/api/managers/me", security.APIKeyPrefix + "wrong", []*audit.Event{{ActorKind: audit.KindAPIKey, Action: "authenticate", Outcome: audit.OutcomeFailure}}},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t)
+		r := httptest.NewRequest(GET, tt.path, nil)
+		r.Header.Set("Authorization", tt.auth)
+		s.ServeHTTP(httptest.NewRecorder(), r)
+
+		events := s.auditSvc.(*fakeAudit).events
+		if len(events) != len(tt.want) {
+			t.Errorf("%s with %q: %d events, want %d", tt.path, tt.auth, len(events), len(tt.want))
+			continue
+		}
+		for i, event := range events {
+			want := tt.want[i]
+			if event.ActorKind != want.ActorKind || event.Action != want.Action || event.Outcome != want.Outcome {
+				t.Errorf("%s with %q: event %+v, want %+v", tt.path, tt.auth, event, want)
+			}
+		}
+	}
+}
+
+func TestAuditedKeepsOutcomeOfHandler(t *testing.T) {
+	s := newTestServer(t)
+	handler := s.audited("login", audit.KindManager, func(w http.ResponseWriter, r *http.Request) {
+		audit.FromContext(r.Context()).Outcome = audit.OutcomeChallenge
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(POST, "/api/managers/token", nil))
+
+	events := s.auditSvc.(*fakeAudit).events
+	if len(events) != 1 || events[0].Outcome != audit.OutcomeChallenge {
+		t.Fatalf("events %+v, want one with outcome %s", events, audit.OutcomeChallenge)
+	}
+}
+
+func TestRecordEventOutlivesRequest(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorded := &recordingAudit{}
+	s.auditSvc = recorded
+	s.recordEvent(httptest.NewRequest(GET, "/", nil).WithContext(ctx), &audit.Event{Action: "customer.delete"})
+	if recorded.err != nil {
+		t.Fatalf("recorded with a cancelled context: %v", recorded.err)
+	}
+}
+
+// recordingAudit remembers the state of the context Record was called with
+type recordingAudit struct {
+	auditService
+	err error
+}
+
+func (f *recordingAudit) Record(ctx context.Context, event *audit.Event) error {
+	f.err = ctx.Err()
+	return nil
+}
@@ -2,219 +2,331 @@ package app
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
-	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/cmd/app/middleware"
+	"github.com/SsSJKK/crud/cmd/app/validate"
+	"github.com/SsSJKK/crud/pkg/audit"
 	"github.com/SsSJKK/crud/pkg/customers"
+	"github.com/SsSJKK/crud/pkg/logging"
 	"github.com/SsSJKK/crud/pkg/security"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func (s *Server) handleGetAllCustomers(w http.ResponseWriter, r *http.Request) {
+// customerFilter reads a listing filter from the query: active, from and to (RFC3339),
+// q (name or phone substring), sort (a field, "-" in front for descending), limit and cursor
+func customerFilter(r *http.Request) (*customers.ListFilter, []apierror.FieldError) {
+	query := r.URL.Query()
+	filter := &customers.ListFilter{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Sort:   strings.TrimPrefix(query.Get("sort"), "-"),
+		Desc:   strings.HasPrefix(query.Get("sort"), "-"),
+		Cursor: query.Get("cursor"),
+	}
+	var fields []apierror.FieldError
+	invalid := func(name string) {
+		fields = append(fields, apierror.FieldError{Field: name, Code: validate.CodeInvalidType})
+	}
+
+	if value := query.Get("active"); value != "" {
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			invalid("active")
+		}
+		filter.Active = &active
+	}
+	if value := query.Get("from"); value != "" {
+		from, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			invalid("from")
+		}
+		filter.From = &from
+	}
+	if value := query.Get("to"); value != "" {
+		to, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			invalid("to")
+		}
+		filter.To = &to
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			invalid("limit")
+		}
+		filter.Limit = limit
+	}
+	return filter, fields
+}
 
-	items, err := s.customersSvc.All(r.Context())
+func (s *Server) listCustomers(w http.ResponseWriter, r *http.Request, filter *customers.ListFilter, view func(item *customers.Customer) interface{}) {
+	page, err := s.customersSvc.List(r.Context(), filter)
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, items)
+	respondJSON(w, r, newCustomerPageView(page, view))
 }
 
-func (s *Server) handleGetAllActiveCustomers(w http.ResponseWriter, r *http.Request) {
-
-	items, err := s.customersSvc.AllActive(r.Context())
-	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+func (s *Server) handleGetAllCustomers(w http.ResponseWriter, r *http.Request) {
+	filter, fields := customerFilter(r)
+	if len(fields) > 0 {
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{Code: apierror.CodeValidation, Fields: fields})
 		return
 	}
+	s.listCustomers(w, r, filter, publicCustomer)
+}
 
-	respondJSON(w, items)
+//handleGetAllActiveCustomers is the listing with active=true
+func (s *Server) handleGetAllActiveCustomers(w http.ResponseWriter, r *http.Request) {
+	filter, fields := customerFilter(r)
+	if len(fields) > 0 {
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{Code: apierror.CodeValidation, Fields: fields})
+		return
+	}
+	active := true
+	filter.Active = &active
+	s.listCustomers(w, r, filter, publicCustomer)
 }
 
 func (s *Server) handleGetCustomerByID(w http.ResponseWriter, r *http.Request) {
 	idP, ok := mux.Vars(r)["id"]
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		apierror.WriteStatus(w, r, http.StatusBadRequest)
 		return
 	}
 	id, err := strconv.ParseInt(idP, 10, 64)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
 	item, err := s.customersSvc.ByID(r.Context(), id)
-	if errors.Is(err, customers.ErrNotFound) {
-		errorWriter(w, http.StatusNotFound, err)
-		return
-	}
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, item)
+	w.Header().Set("ETag", etag(item.Version))
+	respondJSON(w, r, newCustomerPublicView(item))
 }
 
-func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
-	idP, ok := mux.Vars(r)["id"]
+// etag makes the entity tag of a version
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatch reads the versions listed in If-Match, nil for "*"; weak tags never match
+// and unreadable ones are skipped, ok is false when the header is missing
+func ifMatch(r *http.Request) (versions []int64, ok bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return nil, false
+	}
+	if header == "*" {
+		return nil, true
+	}
+	versions = make([]int64, 0)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		version, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions, true
+}
+
+// patchCustomer applies patch to customer id under If-Match and answers with the result
+func (s *Server) patchCustomer(w http.ResponseWriter, r *http.Request, id int64, patch *customers.Patch) {
+	versions, ok := ifMatch(r)
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		apierror.WriteStatus(w, r, http.StatusPreconditionRequired)
 		return
 	}
-	id, err := strconv.ParseInt(idP, 10, 64)
+	item, err := s.customersSvc.Update(r.Context(), id, versions, patch)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("ETag", etag(item.Version))
+	respondJSON(w, r, newCustomerView(item))
+}
+
+func (s *Server) handlePatchCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+	var item customerPatchRequest
+	if !decodePatch(w, r, &item) {
 		return
 	}
-	item, err := s.customersSvc.Delete(r.Context(), id)
+	s.patchCustomer(w, r, id, item.patch())
+}
 
-	if errors.Is(err, customers.ErrNotFound) {
-		errorWriter(w, http.StatusNotFound, err)
+func (s *Server) hCustGetMe(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
 		return
 	}
+
+	item, err := s.customersSvc.ByID(r.Context(), id)
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, item)
+	w.Header().Set("ETag", etag(item.Version))
+	respondJSON(w, r, newCustomerView(item))
 }
 
-func (s *Server) handleSave(w http.ResponseWriter, r *http.Request) {
-	var item *customers.Customer
-	err := json.NewDecoder(r.Body).Decode(&item)
+func (s *Server) hCustPatchMe(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusUnauthorized, err)
 		return
 	}
-	customer, err := s.customersSvc.Save(r.Context(), item)
-	respondJSON(w, customer)
+	var item customerSelfPatchRequest
+	if !decodePatch(w, r, &item) {
+		return
+	}
+	s.patchCustomer(w, r, id, item.patch())
 }
 
 func (s *Server) handleBlockByID(w http.ResponseWriter, r *http.Request) {
 	idP, ok := mux.Vars(r)["id"]
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		apierror.WriteStatus(w, r, http.StatusBadRequest)
 		return
 	}
 	id, err := strconv.ParseInt(idP, 10, 64)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
 	item, err := s.customersSvc.ChangeActive(r.Context(), id, false)
 
-	if errors.Is(err, customers.ErrNotFound) {
-		errorWriter(w, http.StatusNotFound, err)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	// end the sessions now, signed tokens would otherwise live until they expire
+	err = s.securitySvc.RevokeCustomerTokens(r.Context(), id)
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, item)
+	respondJSON(w, r, newCustomerView(item))
 }
 
 func (s *Server) handleUnBlockByID(w http.ResponseWriter, r *http.Request) {
 	idP, ok := mux.Vars(r)["id"]
 	if !ok {
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		apierror.WriteStatus(w, r, http.StatusBadRequest)
 		return
 	}
 	id, err := strconv.ParseInt(idP, 10, 64)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
 	item, err := s.customersSvc.ChangeActive(r.Context(), id, true)
 
-	if errors.Is(err, customers.ErrNotFound) {
-		errorWriter(w, http.StatusNotFound, err)
-		return
-	}
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
-	respondJSON(w, item)
+	respondJSON(w, r, newCustomerView(item))
 }
 
 func (s *Server) apiSave(w http.ResponseWriter, r *http.Request) {
-	var item *customers.Customer
-	err := json.NewDecoder(r.Body).Decode(&item)
-	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+	var item customerRequest
+	if !decodeRequest(w, r, &item) {
 		return
 	}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(item.Password), bcrypt.DefaultCost)
-
-	log.Println(hash)
+	err := security.ValidatePassword(item.Password, item.Phone)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
 
+	hash, err := s.securitySvc.HashPassword(r.Context(), item.Password)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	item.Password = string(hash)
-	customer, err := s.customersSvc.APISave(r.Context(), item)
+	item.Password = hash
+	customer, err := s.customersSvc.APISave(r.Context(), item.customer())
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
-	respondJSON(w, customer)
+	respondJSON(w, r, newCustomerView(customer))
 }
 
 func (s *Server) apiToken(w http.ResponseWriter, r *http.Request) {
-	var item *struct {
-		Login    string `json:"login"`
-		Password string `json:"password"`
+	var item struct {
+		Login    string `json:"login" validate:"required"`
+		Password string `json:"password" validate:"required"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+	if !decodeRequest(w, r, &item) {
 		return
 	}
 
-	token, err := s.securitySvc.TokenForCustomer(r.Context(), item.Login, item.Password)
+	audit.FromContext(r.Context()).Target = item.Login
+
+	token, err := s.securitySvc.TokenForCustomer(r.Context(), item.Login, item.Password, clientFromRequest(r))
+
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondToken(w, r, token)
+}
+
+func (s *Server) hCustRefresh(w http.ResponseWriter, r *http.Request) {
+	var item struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &item) {
+		return
+	}
 
+	token, err := s.securitySvc.RefreshCustomerToken(r.Context(), item.RefreshToken, clientFromRequest(r))
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, map[string]interface{}{"status": "ok", "token": token})
+	respondToken(w, r, token)
 }
 
 func (s *Server) handleValidateToken(w http.ResponseWriter, r *http.Request) {
-	var item *struct {
-		Token string `json:"token"`
+	var item struct {
+		Token string `json:"token" validate:"required"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-		//вызываем фукцию для ответа с ошибкой
-		errorWriter(w, http.StatusBadRequest, err)
+	if !decodeRequest(w, r, &item) {
 		return
 	}
 
 	id, err := s.securitySvc.AuthenticateCustomer(r.Context(), item.Token)
-
 	if err != nil {
-		status := http.StatusInternalServerError
-		text := "internal error"
-		if err == security.ErrNoSuchUser {
-			status = http.StatusNotFound
-			text = "not found"
-		}
-		if err == security.ErrExpireToken {
-			status = http.StatusBadRequest
-			text = "expired"
-		}
-
-		respondJSONWithCode(w, status, map[string]interface{}{"status": "fail", "reason": text})
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -222,53 +334,215 @@ func (s *Server) handleValidateToken(w http.ResponseWriter, r *http.Request) {
 	res["status"] = "ok"
 	res["customerId"] = id
 
-	respondJSONWithCode(w, http.StatusOK, res)
+	respondJSONWithCode(w, r, http.StatusOK, res)
 }
 
 func (s *Server) hCustGetProdeucts(w http.ResponseWriter, r *http.Request) {
 
 	items, err := s.customersSvc.Products(r.Context())
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, items)
+}
+
+func (s *Server) hCustGetPurchases(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	items, err := s.customersSvc.Purchases(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, items)
+	respondJSON(w, r, items)
+}
+
+func (s *Server) hCustMakePurchase(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	var item purchaseRequest
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	purchase, err := s.customersSvc.MakePurchase(r.Context(), id, item.orderItems())
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, r, purchase)
+}
+
+func (s *Server) hCustLogout(w http.ResponseWriter, r *http.Request) {
+	token, err := middleware.Token(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	err = s.securitySvc.RevokeCustomerToken(r.Context(), token)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hCustLogoutAll(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	err = s.securitySvc.RevokeCustomerTokens(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hCustSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	token, err := middleware.Token(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	items, err := s.securitySvc.CustomerSessions(r.Context(), id, token)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, items)
+}
+
+func (s *Server) hCustChangePassword(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	var item struct {
+		OldPassword string `json:"old_password" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required"`
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	err = s.securitySvc.ChangeCustomerPassword(r.Context(), id, item.OldPassword, item.NewPassword)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hCustRequestReset(w http.ResponseWriter, r *http.Request) {
+	var item struct {
+		Phone string `json:"phone" validate:"required"`
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	audit.FromContext(r.Context()).Target = item.Phone
+	err := s.securitySvc.RequestCustomerReset(r.Context(), item.Phone)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hCustConfirmReset(w http.ResponseWriter, r *http.Request) {
+	var item struct {
+		Phone       string `json:"phone" validate:"required"`
+		Code        string `json:"code" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required"`
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	audit.FromContext(r.Context()).Target = item.Phone
+	err := s.securitySvc.ResetCustomerPassword(r.Context(), item.Phone, item.Code, item.NewPassword)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
 }
 
 func (s *Server) pass(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("pass")
-	return
 }
 
-func errorWriter(w http.ResponseWriter, httpSts int, err error) {
-	log.Print(err)
-	http.Error(w, http.StatusText(httpSts), httpSts)
+func respondToken(w http.ResponseWriter, r *http.Request, token *security.Token) {
+	respondJSON(w, r, map[string]interface{}{
+		"status":         "ok",
+		"token":          token.Token,
+		"expire":         token.Expire,
+		"refresh_token":  token.RefreshToken,
+		"refresh_expire": token.RefreshExpire,
+	})
+}
+
+func clientFromRequest(r *http.Request) *security.Client {
+	return &security.Client{UserAgent: r.UserAgent(), IP: middleware.ClientIP(r)}
 }
-func respondJSON(w http.ResponseWriter, iData interface{}) {
+
+func respondJSON(w http.ResponseWriter, r *http.Request, iData interface{}) {
 	data, err := json.Marshal(iData)
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		logging.FromContext(r.Context()).Print(err)
+		apierror.WriteStatus(w, r, http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(data)
 	if err != nil {
-		log.Print(err)
+		logging.FromContext(r.Context()).Print(err)
 	}
 }
 
-func respondJSONWithCode(w http.ResponseWriter, sts int, iData interface{}) {
+func respondJSONWithCode(w http.ResponseWriter, r *http.Request, sts int, iData interface{}) {
 	data, err := json.Marshal(iData)
 	if err != nil {
-		errorWriter(w, http.StatusInternalServerError, err)
+		logging.FromContext(r.Context()).Print(err)
+		apierror.WriteStatus(w, r, http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(sts)
 	_, err = w.Write(data)
 	if err != nil {
-		log.Print(err)
+		logging.FromContext(r.Context()).Print(err)
 	}
 }
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/cmd/app/middleware"
+	"github.com/SsSJKK/crud/pkg/customers"
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/SsSJKK/crud/pkg/managers"
+	"github.com/SsSJKK/crud/pkg/phone"
+	"github.com/SsSJKK/crud/pkg/security"
+	"github.com/SsSJKK/crud/pkg/stock"
+)
+
+// errorStatuses maps service sentinel errors to a status and code,
+// errors missing here get the status the handler falls back to
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{customers.ErrNotFound, http.StatusNotFound, apierror.CodeNotFound},
+	{customers.ErrPhoneInUse, http.StatusConflict, apierror.CodeConflict},
+	{customers.ErrVersionMismatch, http.StatusPreconditionFailed, apierror.CodePreconditionFailed},
+	{customers.ErrInvalidSort, http.StatusBadRequest, apierror.CodeInvalidSort},
+	{customers.ErrInvalidCursor, http.StatusBadRequest, apierror.CodeInvalidCursor},
+	{security.ErrNoSuchUser, http.StatusNotFound, apierror.CodeNotFound},
+	{security.ErrInvalidCredentials, http.StatusUnauthorized, apierror.CodeInvalidCredentials},
+	{security.ErrInvalidToken, http.StatusUnauthorized, apierror.CodeInvalidToken},
+	{security.ErrExpireToken, http.StatusUnauthorized, apierror.CodeTokenExpired},
+	{security.ErrTokenReuse, http.StatusUnauthorized, apierror.CodeTokenReused},
+	{security.ErrBasicNotAllowed, http.StatusUnauthorized, apierror.CodeBasicNotAllowed},
+	{security.ErrInvalidPassword, http.StatusForbidden, apierror.CodeInvalidPassword},
+	{security.ErrInvalidCode, http.StatusBadRequest, apierror.CodeInvalidCode},
+	{security.ErrInvalidTOTP, http.StatusBadRequest, apierror.CodeInvalidTOTP},
+	{security.ErrTOTPEnabled, http.StatusConflict, apierror.CodeTOTPEnabled},
+	{security.ErrInvalidScope, http.StatusBadRequest, apierror.CodeInvalidScope},
+	{security.ErrInvalidAllowlist, http.StatusBadRequest, apierror.CodeInvalidAllowlist},
+	{security.ErrAddressNotAllowed, http.StatusForbidden, apierror.CodeAddressNotAllowed},
+	{managers.ErrNotFound, http.StatusNotFound, apierror.CodeNotFound},
+	{managers.ErrInvalidToken, http.StatusUnauthorized, apierror.CodeInvalidToken},
+	{managers.ErrExpireToken, http.StatusUnauthorized, apierror.CodeTokenExpired},
+	{managers.ErrPriceOverride, http.StatusForbidden, apierror.CodePriceOverride},
+	{managers.ErrNoOverrideReason, http.StatusBadRequest, apierror.CodeNoOverrideReason},
+	{phone.ErrInvalid, http.StatusBadRequest, apierror.CodeBadRequest},
+	{middleware.ErrNoAuthentication, http.StatusUnauthorized, apierror.CodeUnauthorized},
+	{customers.ErrInternal, http.StatusInternalServerError, apierror.CodeInternal},
+	{managers.ErrInternal, http.StatusInternalServerError, apierror.CodeInternal},
+	{security.ErrInternal, http.StatusInternalServerError, apierror.CodeInternal},
+}
+
+// errorWriter answers with the error envelope; known service errors pick their own
+// status and code, anything else is answered with httpSts
+func errorWriter(w http.ResponseWriter, r *http.Request, httpSts int, err error) {
+	logging.FromContext(r.Context()).Print(err)
+
+	var errWait *security.ErrTooManyAttempts
+	if errors.As(err, &errWait) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(errWait.RetryAfter.Seconds()))))
+		apierror.WriteStatus(w, r, http.StatusTooManyRequests)
+		return
+	}
+
+	var errPolicy *security.ErrPasswordPolicy
+	if errors.As(err, &errPolicy) {
+		body := &apierror.Error{Code: apierror.CodeWeakPassword}
+		for _, rule := range errPolicy.Rules {
+			body.Fields = append(body.Fields, apierror.FieldError{Field: "password", Code: rule})
+		}
+		apierror.Write(w, r, http.StatusBadRequest, body)
+		return
+	}
+
+	var errUnknown *stock.ErrUnknownProducts
+	if errors.As(err, &errUnknown) {
+		apierror.Write(w, r, http.StatusNotFound, &apierror.Error{
+			Code:    apierror.CodeNotFound,
+			Details: map[string]interface{}{"product_ids": errUnknown.ProductIDs},
+		})
+		return
+	}
+
+	var errStock *stock.ErrInsufficientStock
+	if errors.As(err, &errStock) {
+		apierror.Write(w, r, http.StatusConflict, &apierror.Error{
+			Code:    apierror.CodeInsufficientStock,
+			Details: map[string]interface{}{"product_ids": errStock.ProductIDs},
+		})
+		return
+	}
+
+	for _, item := range errorStatuses {
+		if errors.Is(err, item.err) {
+			apierror.Write(w, r, item.status, &apierror.Error{Code: item.code})
+			return
+		}
+	}
+
+	apierror.WriteStatus(w, r, httpSts)
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/pkg/security"
+)
+
+func TestAuthenticationErrorCodes(t *testing.T) {
+	tests := []struct {
+		path   string
+		auth   string
+		status int
+		code   string
+	}{
+		{"/api/customers/me", "expired", http.StatusUnauthorized, apierror.CodeTokenExpired},
+		{"/api/customers/me", "wrong", http.StatusUnauthorized, apierror.CodeInvalidToken},
+		{"/api/customers/me", "", http.StatusUnauthorized, apierror.CodeInvalidToken},
+		{"/api/managers/me", security.APIKeyPrefix + "wrong", http.StatusUnauthorized, apierror.CodeInvalidToken},
+	}
+	s := newTestServer(t)
+	for _, tt := range tests {
+		r := httptest.NewRequest(GET, tt.path, nil)
+		r.Header.Set("Authorization", tt.auth)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		body := &apierror.Error{}
+		err := json.Unmarshal(w.Body.Bytes(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status || body.Code != tt.code {
+			t.Errorf("%s with %q: %d %s, want %d %s", tt.path, tt.auth, w.Code, body.Code, tt.status, tt.code)
+		}
+	}
+}
+
+func TestPhoneInUse(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		auth   string
+		body   string
+	}{
+		{POST, "/api/customers", "", `{"name": "Twin", "phone": "+992927776656", "password": "correct horse battery"}`},
+		{PATCH, "/api/customers/me", "customer", `{"phone": "+992927776656"}`},
+		{PATCH, "/api/customers/1", "manager", `{"phone": "+992927776656"}`},
+	}
+	s := newTestServer(t)
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if tt.method == PATCH {
+			r.Header.Set("If-Match", `"1"`)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		body := &apierror.Error{}
+		err := json.Unmarshal(w.Body.Bytes(), body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusConflict || body.Code != apierror.CodeConflict {
+			t.Errorf("%s %s: %d %s, want %d %s", tt.method, tt.path, w.Code, body.Code, http.StatusConflict, apierror.CodeConflict)
+		}
+	}
+}
+
+func TestMakeSale(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`{"customer_id": 1, "positions": [{"product_id": 1, "qty": 2}]}`, http.StatusOK, `{"id":42}`},
+		{`{"customer_id": 1, "positions": [{"product_id": 1, "qty": 2}, {"product_id": 11, "qty": 1}]}`, http.StatusNotFound, ""},
+	}
+	s := newTestServer(t)
+	for _, tt := range tests {
+		r := httptest.NewRequest(POST, "/api/managers/sales", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "manager")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.body, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.want != "" && strings.TrimSpace(w.Body.String()) != tt.want {
+			t.Errorf("%s: body %s, want %s", tt.body, w.Body, tt.want)
+		}
+		if tt.status == http.StatusNotFound {
+			body := &apierror.Error{}
+			err := json.Unmarshal(w.Body.Bytes(), body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Code != apierror.CodeNotFound || !strings.Contains(w.Body.String(), `"product_ids":[11]`) {
+				t.Errorf("%s: body %s", tt.body, w.Body)
+			}
+		}
+	}
+}
@@ -1,123 +1,533 @@
 package app
 
 import (
-	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
+	"strconv"
 
+	"github.com/SsSJKK/crud/cmd/app/apierror"
 	"github.com/SsSJKK/crud/cmd/app/middleware"
+	"github.com/SsSJKK/crud/pkg/audit"
+	"github.com/gorilla/mux"
 
-	"github.com/SsSJKK/crud/pkg/managers"
+	"github.com/SsSJKK/crud/pkg/security"
 )
 
 func (s *Server) hManagerR(w http.ResponseWriter, r *http.Request) {
-	log.Println("hManagerR")
-	var item *managers.Managers
-	id, err := middleware.Authentication(r.Context())
-	log.Println(id, err)
+	var item managerRequest
+	_, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	err = security.ValidatePassword(item.Password, item.Phone)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
-	err = json.NewDecoder(r.Body).Decode(&item)
+	item.Password, err = s.securitySvc.HashPassword(r.Context(), item.Password)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	log.Println(item)
-	manager, err := s.managersSvc.Registration(r.Context(), item)
+	manager, err := s.managersSvc.Registration(r.Context(), item.manager())
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
-	log.Println(item.ID)
+	audit.FromContext(r.Context()).Target = strconv.FormatInt(manager.ID, 10)
 
-	token, err := s.securitySvc.TokenWithOut(r.Context(), manager.ID)
+	token, err := s.securitySvc.TokenWithOut(r.Context(), manager.ID, nil)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
 
-	respondJSON(w, map[string]interface{}{"status": "ok", "token": token})
+	respondToken(w, r, token)
 
 }
 
 func (s *Server) apiTokenManager(w http.ResponseWriter, r *http.Request) {
-	var item *struct {
-		Login    string `json:"phone"`
-		Password string `json:"password"`
+	var item struct {
+		Login    string `json:"phone" validate:"required"`
+		Password string `json:"password" validate:"required"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+	if !decodeRequest(w, r, &item) {
 		return
 	}
 
-	token, err := s.securitySvc.TokenForManager(r.Context(), item.Login, item.Password)
+	audit.FromContext(r.Context()).Target = item.Login
 
+	token, err := s.securitySvc.TokenForManager(r.Context(), item.Login, item.Password, clientFromRequest(r))
+	var errTwoFactor *security.ErrTwoFactorRequired
+	if errors.As(err, &errTwoFactor) {
+		audit.FromContext(r.Context()).Outcome = audit.OutcomeChallenge
+		respondJSON(w, r, map[string]interface{}{
+			"status":     "2fa_required",
+			"challenge":  errTwoFactor.Challenge.Challenge,
+			"expire":     errTwoFactor.Challenge.Expire,
+			"enrollment": errTwoFactor.Challenge.Enrollment,
+		})
+		return
+	}
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	respondJSON(w, map[string]interface{}{"status": "ok", "token": token})
+	respondToken(w, r, token)
 }
 
-func (s *Server) hChProduct(w http.ResponseWriter, r *http.Request) {
-	var item *managers.Product
+func (s *Server) hManagerTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var item struct {
+		Challenge string `json:"challenge" validate:"required"`
+		Code      string `json:"code" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	token, recovery, err := s.securitySvc.CompleteManagerChallenge(r.Context(), item.Challenge, item.Code, clientFromRequest(r))
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{
+		"status":         "ok",
+		"token":          token.Token,
+		"expire":         token.Expire,
+		"refresh_token":  token.RefreshToken,
+		"refresh_expire": token.RefreshExpire,
+		"recovery_codes": recovery,
+	})
+}
+
+func (s *Server) hManagerEnrollTOTP(w http.ResponseWriter, r *http.Request) {
 	id, err := middleware.Authentication(r.Context())
-	log.Println(id, err)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusUnauthorized, err)
 		return
 	}
-	err = json.NewDecoder(r.Body).Decode(&item)
+
+	enrollment, err := s.securitySvc.EnrollManagerTOTP(r.Context(), id)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
 		return
 	}
 
-	log.Println(item)
-	product, err := s.managersSvc.ChangeProduct(r.Context(), item)
+	respondJSON(w, r, enrollment)
+}
+
+func (s *Server) hManagerConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusUnauthorized, err)
 		return
 	}
-	log.Println(item.ID)
 
-	respondJSON(w, map[string]interface{}{"id": product.ID})
+	var item struct {
+		Code string `json:"code" validate:"required"`
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
 
+	recovery, err := s.securitySvc.ConfirmManagerTOTP(r.Context(), id, item.Code)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok", "recovery_codes": recovery})
 }
 
-func (s *Server) hMakeSeles(w http.ResponseWriter, r *http.Request) {
-	var SaleP *managers.SalePositions
-	err := json.NewDecoder(r.Body).Decode(&SaleP)
+func (s *Server) hManagerRefresh(w http.ResponseWriter, r *http.Request) {
+	var item struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	token, err := s.securitySvc.RefreshManagerToken(r.Context(), item.RefreshToken, clientFromRequest(r))
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondToken(w, r, token)
+}
+
+func (s *Server) hChProduct(w http.ResponseWriter, r *http.Request) {
+	var item productRequest
+	_, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	product, err := s.managersSvc.ChangeProduct(r.Context(), item.product())
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"id": product.ID})
+
+}
+
+func (s *Server) hMakeSeles(w http.ResponseWriter, r *http.Request) {
+	var SaleP saleRequest
+	if !decodeRequest(w, r, &SaleP) {
 		return
 	}
 	id, err := middleware.Authentication(r.Context())
-	err = s.managersSvc.MakeSele(r.Context(), SaleP, id)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+	saleID, err := s.managersSvc.MakeSele(r.Context(), SaleP.sale(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
 
-	respondJSON(w, map[string]interface{}{"id": id})
+	respondJSON(w, r, map[string]interface{}{"id": saleID})
 }
 
 func (s *Server) hGetSeles(w http.ResponseWriter, r *http.Request) {
 	id, err := middleware.Authentication(r.Context())
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
 
 	sum, err := s.managersSvc.GetSales(r.Context(), id)
 	if err != nil {
-		errorWriter(w, http.StatusBadRequest, err)
+		errorWriter(w, r, http.StatusBadRequest, err)
 		return
 	}
-	respondJSON(w, map[string]interface{}{
+	respondJSON(w, r, map[string]interface{}{
 		"manager_id":    id,
 		"total": sum,
 	})
 
 }
+
+func (s *Server) hManagerLogout(w http.ResponseWriter, r *http.Request) {
+	token, err := middleware.Token(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	err = s.securitySvc.RevokeManagerToken(r.Context(), token)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hManagerLogoutAll(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	err = s.securitySvc.RevokeManagerTokens(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hManagerSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	token, err := middleware.Token(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	items, err := s.securitySvc.ManagerSessions(r.Context(), id, token)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, items)
+}
+
+func (s *Server) hUnlockCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.securitySvc.UnlockCustomer(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hUnlockManager(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.securitySvc.UnlockManager(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hManagerChangePassword(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	var item struct {
+		OldPassword string `json:"old_password" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required"`
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	err = s.securitySvc.ChangeManagerPassword(r.Context(), id, item.OldPassword, item.NewPassword)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hManagerRequestReset(w http.ResponseWriter, r *http.Request) {
+	var item struct {
+		Phone string `json:"phone" validate:"required"`
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	audit.FromContext(r.Context()).Target = item.Phone
+	err := s.securitySvc.RequestManagerReset(r.Context(), item.Phone)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hManagerConfirmReset(w http.ResponseWriter, r *http.Request) {
+	var item struct {
+		Phone       string `json:"phone" validate:"required"`
+		Code        string `json:"code" validate:"required"`
+		NewPassword string `json:"new_password" validate:"required"`
+	}
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	audit.FromContext(r.Context()).Target = item.Phone
+	err := s.securitySvc.ResetManagerPassword(r.Context(), item.Phone, item.Code, item.NewPassword)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	var item apiKeyRequest
+	if !decodeRequest(w, r, &item) {
+		return
+	}
+
+	apiKey, key, err := s.securitySvc.CreateAPIKey(r.Context(), id, item.apiKey())
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	audit.FromContext(r.Context()).Target = strconv.FormatInt(apiKey.ID, 10)
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok", "key": key, "api_key": apiKey})
+}
+
+func (s *Server) hGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	items, err := s.securitySvc.APIKeys(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, items)
+}
+
+func (s *Server) hGetPasswordStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.securitySvc.PasswordStats(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, stats)
+}
+
+func (s *Server) hRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.securitySvc.RevokeAPIKey(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) hGetManagerMe(w http.ResponseWriter, r *http.Request) {
+	id, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	manager, err := s.managersSvc.ByID(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, newManagerView(manager))
+}
+
+func (s *Server) hGetManager(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	manager, err := s.managersSvc.ByID(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, newManagerView(manager))
+}
+
+func (s *Server) hGetCustomers(w http.ResponseWriter, r *http.Request) {
+	filter, fields := customerFilter(r)
+	if len(fields) > 0 {
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{Code: apierror.CodeValidation, Fields: fields})
+		return
+	}
+	filter.Phones = true
+	s.listCustomers(w, r, filter, staffCustomer)
+}
+
+func (s *Server) hGetCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	item, err := s.customersSvc.ByID(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(item.Version))
+	respondJSON(w, r, newCustomerView(item))
+}
+
+func (s *Server) hDeleteCustomer(w http.ResponseWriter, r *http.Request) {
+	actorID, err := middleware.Authentication(r.Context())
+	if err != nil {
+		errorWriter(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	item, err := s.customersSvc.Delete(r.Context(), id, actorID)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	err = s.securitySvc.RevokeCustomerTokens(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, newCustomerView(item))
+}
+
+func (s *Server) hRestoreCustomer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		errorWriter(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	item, err := s.customersSvc.Restore(r.Context(), id)
+	if err != nil {
+		errorWriter(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	respondJSON(w, r, newCustomerView(item))
+}
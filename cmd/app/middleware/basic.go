@@ -1,37 +1,68 @@
 package middleware
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
-	"log"
 	"net/http"
 	"strings"
+
 )
 
+//BasicFunc ...
+type BasicFunc func(r *http.Request, login, password string) (int64, error)
+
 //Basic ...
-func Basic(checkAuth func(string, string) bool) func(handler http.Handler) http.Handler {
+func Basic(basicFunc BasicFunc) func(handler http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			login, pass, err := getLoginPass(r)
 			if err != nil {
-				log.Println(err)
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				w.Header().Set("WWW-Authenticate", `Basic realm="api"`)
+				WriteError(w, r, http.StatusUnauthorized, err)
 				return
 			}
-			if !checkAuth(login, pass) {
-				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			id, err := basicFunc(r, login, pass)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="api"`)
+				WriteError(w, r, http.StatusUnauthorized, err)
 				return
 			}
+
+			noteAuthentication(r.Context(), id)
+			ctx := context.WithValue(r.Context(), authenticationContextKey, id)
+			r = r.WithContext(ctx)
+
 			handler.ServeHTTP(w, r)
 		})
 	}
 }
+
+//BasicOr uses Basic for requests with Basic credentials and tokenMd for the rest
+func BasicOr(basicFunc BasicFunc, tokenMd func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	basicMd := Basic(basicFunc)
+	return func(handler http.Handler) http.Handler {
+		basic := basicMd(handler)
+		token := tokenMd(handler)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Basic ") {
+				basic.ServeHTTP(w, r)
+				return
+			}
+			token.ServeHTTP(w, r)
+		})
+	}
+}
+
 func getLoginPass(r *http.Request) (string, string, error) {
 	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 	if len(auth) != 2 || auth[0] != "Basic" {
 		return "", "", errors.New("invalid auth method")
 	}
-	payload, _ := base64.StdEncoding.DecodeString(auth[1])
+	payload, err := base64.StdEncoding.DecodeString(auth[1])
+	if err != nil {
+		return "", "", errors.New("invalid auth data")
+	}
 	pair := strings.SplitN(string(payload), ":", 2)
 	if len(pair) != 2 {
 		return "", "", errors.New("invalid auth data")
@@ -3,18 +3,38 @@ package middleware
 import (
 	"context"
 	"net/http"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
 )
 
 type HasAnyRoleFunc func(ctx context.Context, roles ...string) bool
 
-func CheckRole(hasAnyRoleFunc HasAnyRoleFunc, roles ...string) func(http.Handler) http.Handler {
+//CheckAccess lets API key requests through only with scope, and other requests
+//only with any of roles; no roles means any authenticated user, empty scope
+//means the route is closed to API keys
+func CheckAccess(hasAnyRoleFunc HasAnyRoleFunc, scope string, roles ...string) func(http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if !hasAnyRoleFunc(r.Context(), roles...) {
-				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			ok := true
+			if scopes, isKey := Scopes(r.Context()); isKey {
+				ok = scope != "" && hasScope(scopes, scope)
+			} else if len(roles) != 0 {
+				ok = hasAnyRoleFunc(r.Context(), roles...)
+			}
+			if !ok {
+				apierror.WriteStatus(w, r, http.StatusForbidden)
 				return
 			}
 			handler.ServeHTTP(w, r)
 		})
 	}
 }
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
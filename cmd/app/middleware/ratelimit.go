@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/gorilla/mux"
+)
+
+//Limit is a token bucket budget: up to Requests at once, refilled evenly over Per
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+//LimitState is what a store answers after taking a token
+type LimitState struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token when Allowed is false
+	RetryAfter time.Duration
+}
+
+//LimitStore keeps buckets, the in-memory store suits a single instance,
+//several instances need a shared implementation
+type LimitStore interface {
+	Take(ctx context.Context, key string, limit Limit) (*LimitState, error)
+}
+
+//KeyFunc names the client a request is counted against
+type KeyFunc func(r *http.Request) string
+
+//RateLimit limits requests per route and client, limits are keyed by "METHOD /path/template"
+//and routes missing there get defaultLimit; store errors let the request through
+func RateLimit(store LimitStore, limits map[string]Limit, defaultLimit Limit, keyFunc KeyFunc) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			route = r.Method + " " + route
+			limit, ok := limits[route]
+			if !ok {
+				limit = defaultLimit
+			}
+
+			state, err := store.Take(r.Context(), route+"|"+keyFunc(r), limit)
+			if err != nil {
+				logging.FromContext(r.Context()).Println(err)
+				handler.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.Remaining))
+			w.Header().Set("RateLimit-Reset", seconds(state.Reset))
+			if !state.Allowed {
+				w.Header().Set("Retry-After", seconds(state.RetryAfter))
+				apierror.WriteStatus(w, r, http.StatusTooManyRequests)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+//ClientIP ...
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+//IPKey counts every request per IP, whoever it claims to be
+func IPKey(r *http.Request) string {
+	return "ip:" + ClientIP(r)
+}
+
+//ClientKey counts API key requests per key, other authenticated requests per user
+//and the rest per IP; behind the authentication middleware it sees the identity
+func ClientKey(r *http.Request) string {
+	if _, ok := Scopes(r.Context()); ok {
+		sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+		return "key:" + hex.EncodeToString(sum[:])
+	}
+	if id, err := Authentication(r.Context()); err == nil {
+		return "id:" + strconv.FormatInt(id, 10)
+	}
+	return IPKey(r)
+}
+
+// sweepEvery is how many takes pass between dropping idle buckets
+const sweepEvery = 1024
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+//MemoryStore is an in-process token bucket LimitStore
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	takes   int
+}
+
+//NewMemoryStore ...
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+//Take ...
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (*LimitState, error) {
+	now := time.Now()
+	capacity := float64(limit.Requests)
+	rate := capacity / limit.Per.Seconds()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.takes++
+	if s.takes%sweepEvery == 0 {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	state := &LimitState{}
+	if b.tokens >= 1 {
+		b.tokens--
+		state.Allowed = true
+	} else {
+		state.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	state.Remaining = int(b.tokens)
+	state.Reset = time.Duration((capacity - b.tokens) / rate * float64(time.Second))
+	b.full = now.Add(state.Reset)
+	return state, nil
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/gorilla/mux"
+)
+
+// maxRequestIDLength bounds an X-Request-ID taken from the client
+const maxRequestIDLength = 128
+
+var accessContextKey = &contextKey{"access context"}
+
+// accessEntry is one access log line, inner middlewares fill in what only they know
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route,omitempty"`
+	Status    int       `json:"status"`
+	LatencyMS float64   `json:"latency_ms"`
+	UserID    *int64    `json:"user_id,omitempty"`
+	IP        string    `json:"ip"`
+}
+
+//StatusRecorder remembers the status a handler answered with
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status      int
+	wroteHeader bool
+}
+
+//WriteHeader ...
+func (w *StatusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.Status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusRecorder) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
+
+//RequestID takes a sane X-Request-ID from the client or makes one up, echoes it
+//in the response and puts it with a request-scoped logger into the context
+func RequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			buffer := make([]byte, 16)
+			_, _ = rand.Read(buffer)
+			id = hex.EncodeToString(buffer)
+		}
+		w.Header().Set("X-Request-ID", id)
+		handler.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+//AccessLog writes one JSON line per request to out
+func AccessLog(out io.Writer) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	encoder := json.NewEncoder(out)
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := &accessEntry{
+				Time:      time.Now(),
+				RequestID: logging.RequestID(r.Context()),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				IP:        ClientIP(r),
+			}
+			recorder := &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+			handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessContextKey, entry)))
+
+			entry.Status = recorder.Status
+			entry.LatencyMS = float64(time.Since(entry.Time).Microseconds()) / 1000
+			mu.Lock()
+			err := encoder.Encode(entry)
+			mu.Unlock()
+			if err != nil {
+				logging.FromContext(r.Context()).Println(err)
+			}
+		})
+	}
+}
+
+//AccessRoute notes the matched route template for the access log, it belongs on the root router
+func AccessRoute(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if entry, ok := r.Context().Value(accessContextKey).(*accessEntry); ok {
+			if route := mux.CurrentRoute(r); route != nil {
+				entry.Route, _ = route.GetPathTemplate()
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// noteAuthentication puts the authenticated ID into the access log line, if there is one,
+// and tells OnAuthFailure that the request got past authentication
+func noteAuthentication(ctx context.Context, id int64) {
+	if entry, ok := ctx.Value(accessContextKey).(*accessEntry); ok {
+		entry.UserID = &id
+	}
+	if authenticated, ok := ctx.Value(authenticatedContextKey).(*bool); ok {
+		*authenticated = true
+	}
+}
+
+//Recover turns a panic into a 500 carrying the request ID and logs it with the stack
+func Recover(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+		defer func() {
+			value := recover()
+			if value == nil {
+				return
+			}
+			if value == http.ErrAbortHandler {
+				panic(value)
+			}
+			logging.FromContext(r.Context()).Printf("panic: %v\n%s", value, debug.Stack())
+			if recorder.wroteHeader {
+				return
+			}
+			apierror.WriteStatus(w, r, http.StatusInternalServerError)
+		}()
+		handler.ServeHTTP(recorder, r)
+	})
+}
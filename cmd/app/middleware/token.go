@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"strings"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/pkg/logging"
 )
 
 // ErrNoAuthentication ...
@@ -11,6 +15,14 @@ var ErrNoAuthentication = errors.New("no authentication")
 
 var authenticationContextKey = &contextKey{"authentication context"}
 
+var tokenContextKey = &contextKey{"token context"}
+
+var rolesContextKey = &contextKey{"roles context"}
+
+var scopesContextKey = &contextKey{"scopes context"}
+
+var authenticatedContextKey = &contextKey{"authenticated context"}
+
 type contextKey struct {
 	name string
 }
@@ -21,21 +33,44 @@ func (c *contextKey) string() string {
 
 var r *http.Request
 
+//WriteError answers requests that fail authentication, status is the fallback for errors
+//it doesn't know; the server replaces it with the one that maps its own errors
+var WriteError = func(w http.ResponseWriter, r *http.Request, status int, err error) {
+	logging.FromContext(r.Context()).Println(err)
+	apierror.WriteStatus(w, r, status)
+}
+
 //IDFunc ...
 type IDFunc func(ctx context.Context, token string) (int64, error)
 
 //Authenticate ...
 func Authenticate(idFunc IDFunc) func(http.Handler) http.Handler {
+	return AuthenticateClaims(func(ctx context.Context, token string) (int64, []string, error) {
+		id, err := idFunc(ctx, token)
+		return id, nil, err
+	})
+}
+
+//ClaimsFunc ...
+type ClaimsFunc func(ctx context.Context, token string) (int64, []string, error)
+
+//AuthenticateClaims ...
+func AuthenticateClaims(claimsFunc ClaimsFunc) func(http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			token := r.Header.Get("Authorization")
-			id, err := idFunc(r.Context(), token)
-			if err != nil && r.URL.Path != "/api/managers/token" {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			id, roles, err := claimsFunc(r.Context(), token)
+			if err != nil {
+				WriteError(w, r, http.StatusUnauthorized, err)
 				return
 			}
 
+			noteAuthentication(r.Context(), id)
 			ctx := context.WithValue(r.Context(), authenticationContextKey, id)
+			ctx = context.WithValue(ctx, tokenContextKey, token)
+			if roles != nil {
+				ctx = context.WithValue(ctx, rolesContextKey, roles)
+			}
 			r = r.WithContext(ctx)
 
 			handler.ServeHTTP(w, r)
@@ -50,3 +85,70 @@ func Authentication(ctx context.Context) (int64, error) {
 	}
 	return 0, ErrNoAuthentication
 }
+
+//Token ...
+func Token(ctx context.Context) (string, error) {
+	if value, ok := ctx.Value(tokenContextKey).(string); ok {
+		return value, nil
+	}
+	return "", ErrNoAuthentication
+}
+
+//Roles returns roles carried by the token itself, if any
+func Roles(ctx context.Context) ([]string, bool) {
+	value, ok := ctx.Value(rolesContextKey).([]string)
+	return value, ok
+}
+
+//APIKeyFunc ...
+type APIKeyFunc func(r *http.Request, key string) (int64, []string, error)
+
+//APIKeyOr uses apiKeyFunc for Authorization values starting with prefix and tokenMd for the rest
+func APIKeyOr(prefix string, apiKeyFunc APIKeyFunc, tokenMd func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		token := tokenMd(handler)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Authorization")
+			if !strings.HasPrefix(key, prefix) {
+				token.ServeHTTP(w, r)
+				return
+			}
+			id, scopes, err := apiKeyFunc(r, key)
+			if err != nil {
+				WriteError(w, r, http.StatusUnauthorized, err)
+				return
+			}
+			if scopes == nil {
+				scopes = []string{}
+			}
+
+			noteAuthentication(r.Context(), id)
+			ctx := context.WithValue(r.Context(), authenticationContextKey, id)
+			ctx = context.WithValue(ctx, scopesContextKey, scopes)
+			r = r.WithContext(ctx)
+
+			handler.ServeHTTP(w, r)
+		})
+	}
+}
+
+//Scopes returns API key scopes, ok is false for requests not made with an API key
+func Scopes(ctx context.Context) ([]string, bool) {
+	value, ok := ctx.Value(scopesContextKey).([]string)
+	return value, ok
+}
+
+//OnAuthFailure calls record for requests that the authentication middleware further
+//down the chain turns away, they never reach a handler
+func OnAuthFailure(record func(r *http.Request)) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authenticated := false
+			recorder := &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+			handler.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), authenticatedContextKey, &authenticated)))
+			if !authenticated && recorder.Status == http.StatusUnauthorized {
+				record(r)
+			}
+		})
+	}
+}
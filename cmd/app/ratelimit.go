@@ -0,0 +1,27 @@
+package app
+
+import (
+	"time"
+
+	"github.com/SsSJKK/crud/cmd/app/middleware"
+)
+
+// defaultRateLimit applies per client to every route missing in rateLimits
+var defaultRateLimit = middleware.Limit{Requests: 300, Per: time.Minute}
+
+// rateLimits are the per-route budgets keyed by method and path template
+var rateLimits = map[string]middleware.Limit{
+	"POST /api/customers/token":                  {Requests: 10, Per: time.Minute},
+	"POST /api/customers/token/refresh":          {Requests: 30, Per: time.Minute},
+	"POST /api/customers/password/reset":         {Requests: 3, Per: 15 * time.Minute},
+	"POST /api/customers/password/reset/confirm": {Requests: 10, Per: 15 * time.Minute},
+	"POST /api/customers":                        {Requests: 20, Per: time.Hour},
+	"GET /api/customers":                         {Requests: 60, Per: time.Minute},
+	"GET /api/customers/active":                  {Requests: 60, Per: time.Minute},
+	"POST /api/managers/token":                   {Requests: 10, Per: time.Minute},
+	"POST /api/managers/token/2fa":               {Requests: 10, Per: time.Minute},
+	"POST /api/managers/token/refresh":           {Requests: 30, Per: time.Minute},
+	"POST /api/managers/password/reset":          {Requests: 3, Per: 15 * time.Minute},
+	"POST /api/managers/password/reset/confirm":  {Requests: 10, Per: 15 * time.Minute},
+	"GET /api/managers/audit.csv":                {Requests: 10, Per: time.Minute},
+}
@@ -0,0 +1,245 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/cmd/app/validate"
+	"github.com/SsSJKK/crud/pkg/customers"
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/SsSJKK/crud/pkg/managers"
+	"github.com/SsSJKK/crud/pkg/security"
+)
+
+// maxBodySize bounds every JSON request body
+const maxBodySize = 1 << 20
+
+// errTrailingData is returned for a body with anything but whitespace after its JSON value
+var errTrailingData = errors.New("json: data after the request value")
+
+// customerRequest is the public signup, it only creates: customers are edited through
+// PATCH /api/customers/me and staff's PATCH /api/customers/{id}
+type customerRequest struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Phone    string `json:"phone" validate:"required,phone"`
+	Password string `json:"password" validate:"max=128"`
+}
+
+func (item *customerRequest) customer() *customers.Customer {
+	return &customers.Customer{Name: item.Name, Phone: item.Phone, Password: item.Password}
+}
+
+// customerPatchRequest is a merge patch of a customer by staff, absent fields are kept
+type customerPatchRequest struct {
+	Name   *string `json:"name" validate:"min=1,max=100"`
+	Phone  *string `json:"phone" validate:"phone"`
+	Active *bool   `json:"active"`
+}
+
+func (item *customerPatchRequest) patch() *customers.Patch {
+	return &customers.Patch{Name: item.Name, Phone: item.Phone, Active: item.Active}
+}
+
+// customerSelfPatchRequest is what customers may change about themselves
+type customerSelfPatchRequest struct {
+	Name  *string `json:"name" validate:"min=1,max=100"`
+	Phone *string `json:"phone" validate:"phone"`
+}
+
+func (item *customerSelfPatchRequest) patch() *customers.Patch {
+	return &customers.Patch{Name: item.Name, Phone: item.Phone}
+}
+
+type managerRequest struct {
+	Name     string   `json:"name" validate:"required,max=100"`
+	Phone    string   `json:"phone" validate:"required,phone"`
+	Password string   `json:"password" validate:"required,max=128"`
+	Roles    []string `json:"roles" validate:"required,oneof=ADMIN MANAGER DISCOUNT"`
+}
+
+func (item *managerRequest) manager() *managers.Managers {
+	return &managers.Managers{Name: item.Name, Phone: item.Phone, Password: item.Password, Roles: item.Roles}
+}
+
+type productRequest struct {
+	ID    int64  `json:"id" validate:"min=0"`
+	Name  string `json:"name" validate:"required,max=200"`
+	Price int    `json:"price" validate:"gt=0"`
+	Qty   int    `json:"qty" validate:"min=0"`
+}
+
+func (item *productRequest) product() *managers.Product {
+	return &managers.Product{ID: item.ID, Name: item.Name, Price: item.Price, Qty: item.Qty}
+}
+
+type salePositionRequest struct {
+	ProductID int64  `json:"product_id" validate:"gt=0"`
+	Qty       int64  `json:"qty" validate:"gt=0"`
+	Price     int64  `json:"price" validate:"min=0"`
+	Reason    string `json:"reason" validate:"max=200"`
+}
+
+type saleRequest struct {
+	CustomerID int64                  `json:"customer_id" validate:"gt=0"`
+	Positions  []*salePositionRequest `json:"positions" validate:"required,min=1,max=100"`
+}
+
+func (item *saleRequest) sale() *managers.SalePositions {
+	sale := &managers.SalePositions{CustomerID: item.CustomerID}
+	for _, v := range item.Positions {
+		sale.Positions = append(sale.Positions, &managers.Position{
+			ProductID: v.ProductID,
+			Qty:       v.Qty,
+			Price:     v.Price,
+			Reason:    v.Reason,
+		})
+	}
+	return sale
+}
+
+type orderItemRequest struct {
+	ProductID int64 `json:"product_id" validate:"gt=0"`
+	Qty       int64 `json:"qty" validate:"gt=0"`
+}
+
+type purchaseRequest struct {
+	Positions []*orderItemRequest `json:"positions" validate:"required,min=1,max=100"`
+}
+
+func (item *purchaseRequest) orderItems() []*customers.OrderItem {
+	items := make([]*customers.OrderItem, 0, len(item.Positions))
+	for _, v := range item.Positions {
+		items = append(items, &customers.OrderItem{ProductID: v.ProductID, Qty: v.Qty})
+	}
+	return items
+}
+
+type apiKeyRequest struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required"`
+	Allowlist []string   `json:"ip_allowlist"`
+	Expire    *time.Time `json:"expire"`
+}
+
+func (item *apiKeyRequest) apiKey() *security.APIKey {
+	return &security.APIKey{Name: item.Name, Scopes: item.Scopes, Allowlist: item.Allowlist, Expire: item.Expire}
+}
+
+// decodeRequest reads a JSON body of bounded size into dst, rejecting unknown fields,
+// and checks its validate tags; on failure it has already answered
+func decodeRequest(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	err := decodeStrict(http.MaxBytesReader(w, r.Body, maxBodySize), dst)
+	if err != nil {
+		logging.FromContext(r.Context()).Print(err)
+		decodeError(w, r, err)
+		return false
+	}
+
+	fields := validate.Struct(dst)
+	if len(fields) != 0 {
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{Code: apierror.CodeValidation, Fields: fields})
+		return false
+	}
+	return true
+}
+
+// decodePatch reads a JSON Merge Patch (RFC 7396) into dst, a struct of pointers;
+// null would remove a member, none of the patchable fields can go, so it is refused
+func decodePatch(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if mediaType != "application/merge-patch+json" && mediaType != "application/json" {
+		apierror.WriteStatus(w, r, http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		logging.FromContext(r.Context()).Print(err)
+		decodeError(w, r, err)
+		return false
+	}
+	var members map[string]json.RawMessage
+	err = json.Unmarshal(body, &members)
+	if err != nil {
+		logging.FromContext(r.Context()).Print(err)
+		decodeError(w, r, err)
+		return false
+	}
+	var fields []apierror.FieldError
+	for name, value := range members {
+		if string(value) == "null" {
+			fields = append(fields, apierror.FieldError{Field: name, Code: validate.CodeRequired})
+		}
+	}
+	if len(fields) != 0 {
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Field < fields[j].Field
+		})
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{Code: apierror.CodeValidation, Fields: fields})
+		return false
+	}
+
+	err = decodeStrict(bytes.NewReader(body), dst)
+	if err != nil {
+		logging.FromContext(r.Context()).Print(err)
+		decodeError(w, r, err)
+		return false
+	}
+
+	fields = validate.Struct(dst)
+	if len(fields) != 0 {
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{Code: apierror.CodeValidation, Fields: fields})
+		return false
+	}
+	return true
+}
+
+// decodeStrict decodes the single JSON value of body into dst, rejecting unknown fields
+// and whatever follows the value
+func decodeStrict(body io.Reader, dst interface{}) error {
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(dst)
+	if err != nil {
+		return err
+	}
+	var trailing json.RawMessage
+	err = decoder.Decode(&trailing)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return errTrailingData
+}
+
+func decodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var errType *json.UnmarshalTypeError
+	switch {
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{
+			Code:   apierror.CodeValidation,
+			Fields: []apierror.FieldError{{Field: field, Code: validate.CodeUnknownField}},
+		})
+	case errors.As(err, &errType):
+		apierror.Write(w, r, http.StatusBadRequest, &apierror.Error{
+			Code:   apierror.CodeValidation,
+			Fields: []apierror.FieldError{{Field: errType.Field, Code: validate.CodeInvalidType}},
+		})
+	// http.MaxBytesReader reports the limit only by this text
+	case err.Error() == "http: request body too large":
+		apierror.WriteStatus(w, r, http.StatusRequestEntityTooLarge)
+	default:
+		apierror.WriteStatus(w, r, http.StatusBadRequest)
+	}
+}
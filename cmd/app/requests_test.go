@@ -0,0 +1,58 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRequest(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"name": "New", "phone": "+992927776658"}`, http.StatusOK},
+		{"{\"name\": \"New\", \"phone\": \"+992927776658\"}\n\t ", http.StatusOK},
+		{`{"name": "New", "phone": "+992927776658"}{"name": "Other"}`, http.StatusBadRequest},
+		{`{"name": "New", "phone": "+992927776658"} []`, http.StatusBadRequest},
+		{`{"name": "New", "phone": "+992927776658"} garbage`, http.StatusBadRequest},
+		{`{"name": "New", "phone": "+992927776658", "admin": true}`, http.StatusBadRequest},
+		{`{"name": "New"`, http.StatusBadRequest},
+		{`{"name": "New", "phone": "+992927776658"}` + strings.Repeat(" ", maxBodySize), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(POST, "/", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		item := &customerRequest{}
+		if decodeRequest(w, r, item) {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.status {
+			t.Errorf("%.60q: status %d, want %d", tt.body, w.Code, tt.status)
+		}
+	}
+}
+
+func TestDecodePatch(t *testing.T) {
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"name": "Me"}`, http.StatusOK},
+		{`{"name": "Me"} {"name": "Other"}`, http.StatusBadRequest},
+		{`{"name": null}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(PATCH, "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/merge-patch+json")
+		w := httptest.NewRecorder()
+		item := &customerPatchRequest{}
+		if decodePatch(w, r, item) {
+			w.WriteHeader(http.StatusOK)
+		}
+		if w.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.body, w.Code, tt.status)
+		}
+	}
+}
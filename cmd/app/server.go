@@ -2,11 +2,14 @@ package app
 
 import (
 	"net/http"
+	"os"
 
+	"github.com/SsSJKK/crud/cmd/app/apierror"
 	"github.com/SsSJKK/crud/cmd/app/middleware"
 
 	"github.com/gorilla/mux"
 
+	"github.com/SsSJKK/crud/pkg/audit"
 	"github.com/SsSJKK/crud/pkg/customers"
 	"github.com/SsSJKK/crud/pkg/managers"
 	"github.com/SsSJKK/crud/pkg/security"
@@ -15,18 +18,46 @@ import (
 //Server ...
 type Server struct {
 	mux          *mux.Router
-	customersSvc *customers.Service
-	securitySvc  *security.Service
-	managersSvc  *managers.Service
+	handler      http.Handler
+	config       *Config
+	customersSvc customersService
+	securitySvc  securityService
+	managersSvc  managersService
+	auditSvc     auditService
+	limitStore   middleware.LimitStore
+}
+
+//Config ...
+type Config struct {
+	// BasicCustomers accepts Basic auth (phone:password) on customer routes besides tokens
+	BasicCustomers bool
+	// BasicManagers accepts Basic auth (phone:password) on manager routes besides tokens
+	BasicManagers bool
 }
 
 //NewServer ...
-func NewServer(m *mux.Router, cSvc *customers.Service, sSvc *security.Service, mSvc *managers.Service) *Server {
-	return &Server{mux: m, customersSvc: cSvc, securitySvc: sSvc, managersSvc: mSvc}
+func NewServer(
+	m *mux.Router,
+	config *Config,
+	cSvc *customers.Service,
+	sSvc *security.Service,
+	mSvc *managers.Service,
+	aSvc *audit.Service,
+	limitStore middleware.LimitStore,
+) *Server {
+	return &Server{
+		mux:          m,
+		config:       config,
+		customersSvc: cSvc,
+		securitySvc:  sSvc,
+		managersSvc:  mSvc,
+		auditSvc:     aSvc,
+		limitStore:   limitStore,
+	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.mux.ServeHTTP(w, r)
+	s.handler.ServeHTTP(w, r)
 }
 
 const (
@@ -36,42 +67,120 @@ const (
 	POST = "POST"
 	//DELETE ...
 	DELETE = "DELETE"
+	//PATCH ...
+	PATCH = "PATCH"
 )
 
 //Init ...
 func (s *Server) Init() {
-	//customersAythMd := middleware.Authenticate(s.customersSvc.IDByToken)
+	s.mux.Use(middleware.AccessRoute)
+	s.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apierror.WriteStatus(w, r, http.StatusNotFound)
+	})
+	s.mux.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apierror.WriteStatus(w, r, http.StatusMethodNotAllowed)
+	})
+	middleware.WriteError = errorWriter
+	s.handler = middleware.RequestID(middleware.AccessLog(os.Stdout)(middleware.Recover(s.mux)))
+
+	customersAythMd := middleware.AuthenticateClaims(s.securitySvc.CustomerClaims)
+	if s.config.BasicCustomers {
+		customersAythMd = middleware.BasicOr(func(r *http.Request, login, password string) (int64, error) {
+			return s.securitySvc.AuthCustomer(r.Context(), login, password, clientFromRequest(r))
+		}, customersAythMd)
+	}
+
+	// public and authenticated routes sit in sibling subrouters so that every request
+	// passes one rate limiter, behind authentication it counts per identity; ipLimit
+	// runs ahead of authentication so that requests with bad credentials count too
+	limit := middleware.RateLimit(s.limitStore, rateLimits, defaultRateLimit, middleware.ClientKey)
+	ipLimit := middleware.RateLimit(s.limitStore, rateLimits, defaultRateLimit, middleware.IPKey)
 
 	customersSubRouter := s.mux.PathPrefix("/api/customers").Subrouter()
-	//customersSubRouter.Use(customersAythMd)
+	customersSubRouter.Use(limit)
 
 	customersSubRouter.HandleFunc("/active", s.handleGetAllActiveCustomers).Methods(GET)
 	customersSubRouter.HandleFunc("", s.handleGetAllCustomers).Methods(GET)
-	customersSubRouter.HandleFunc("/{id}", s.handleGetCustomerByID).Methods(GET)
-	//customersSubRouter.HandleFunc("", s.handleSave).Methods(POST)
-	customersSubRouter.HandleFunc("/{id}", s.handleDelete).Methods(DELETE)
-	customersSubRouter.HandleFunc("/{id}/block", s.handleBlockByID).Methods(POST)
-	customersSubRouter.HandleFunc("/{id}/block", s.handleUnBlockByID).Methods(DELETE)
-	customersSubRouter.HandleFunc("", s.apiSave).Methods(POST)
-	customersSubRouter.HandleFunc("/token", s.apiToken).Methods(POST)
+	customersSubRouter.HandleFunc("/{id:[0-9]+}", s.handleGetCustomerByID).Methods(GET)
+	customersSubRouter.HandleFunc("", s.audited("customer.save", audit.KindCustomer, s.apiSave)).Methods(POST)
+	customersSubRouter.HandleFunc("/token", s.audited("login", audit.KindCustomer, s.apiToken)).Methods(POST)
 	customersSubRouter.HandleFunc("/token/validate", s.handleValidateToken).Methods(POST)
-	customersSubRouter.HandleFunc("products", s.hCustGetProdeucts).Methods(GET)
-	customersSubRouter.HandleFunc("/purchases", s.pass).Methods(GET)
-	customersSubRouter.HandleFunc("/purchases", s.pass).Methods(POST)
-	//s.mux.Use(middleware.Basic(s.securitySvc.Auth))
+	customersSubRouter.HandleFunc("/token/refresh", s.audited("token.refresh", audit.KindCustomer, s.hCustRefresh)).Methods(POST)
+	customersSubRouter.HandleFunc("/products", s.hCustGetProdeucts).Methods(GET)
+	customersSubRouter.HandleFunc("/password/reset", s.audited("password.reset.request", audit.KindCustomer, s.hCustRequestReset)).Methods(POST)
+	customersSubRouter.HandleFunc("/password/reset/confirm", s.audited("password.reset", audit.KindCustomer, s.hCustConfirmReset)).Methods(POST)
+
+	customersAuthSubRouter := s.mux.PathPrefix("/api/customers").Subrouter()
+	customersAuthSubRouter.Use(ipLimit, s.auditedAuth(audit.KindCustomer), customersAythMd, limit)
+	customersAuthSubRouter.HandleFunc("/purchases", s.hCustGetPurchases).Methods(GET)
+	customersAuthSubRouter.HandleFunc("/purchases", s.hCustMakePurchase).Methods(POST)
+	customersAuthSubRouter.HandleFunc("/logout", s.audited("logout", audit.KindCustomer, s.hCustLogout)).Methods(POST)
+	customersAuthSubRouter.HandleFunc("/logout/all", s.audited("logout.all", audit.KindCustomer, s.hCustLogoutAll)).Methods(POST)
+	customersAuthSubRouter.HandleFunc("/sessions", s.hCustSessions).Methods(GET)
+	customersAuthSubRouter.HandleFunc("/me", s.hCustGetMe).Methods(GET)
+	customersAuthSubRouter.HandleFunc("/me", s.audited("customer.update", audit.KindCustomer, s.hCustPatchMe)).Methods(PATCH)
+	customersAuthSubRouter.HandleFunc("/password", s.audited("password.change", audit.KindCustomer, s.hCustChangePassword)).Methods(POST)
 
 	managersAythMd := middleware.Authenticate(s.managersSvc.IDByToken)
+	if s.securitySvc.Stateless() {
+		managersAythMd = middleware.AuthenticateClaims(s.securitySvc.ManagerClaims)
+	}
+	if s.config.BasicManagers {
+		managersAythMd = middleware.BasicOr(func(r *http.Request, login, password string) (int64, error) {
+			return s.securitySvc.AuthManager(r.Context(), login, password, clientFromRequest(r))
+		}, managersAythMd)
+	}
+	managersAythMd = middleware.APIKeyOr(security.APIKeyPrefix, func(r *http.Request, key string) (int64, []string, error) {
+		return s.securitySvc.AuthenticateAPIKey(r.Context(), key, clientFromRequest(r))
+	}, managersAythMd)
+	managersRoute := func(handler http.HandlerFunc, scope string, roles ...string) http.HandlerFunc {
+		return middleware.CheckAccess(s.managersSvc.HasAnyRole, scope, roles...)(handler).ServeHTTP
+	}
+	admin := []string{managers.RoleAdmin}
+	staff := []string{managers.RoleAdmin, managers.RoleManager}
 
 	managersSubrouter := s.mux.PathPrefix("/api/managers").Subrouter()
-	managersSubrouter.Use(managersAythMd)
-	managersSubrouter.HandleFunc("", s.hManagerR).Methods(POST)
-	managersSubrouter.HandleFunc("/token", s.apiTokenManager).Methods(POST)
-	managersSubrouter.HandleFunc("/token/validate", s.pass).Methods(POST)
-	managersSubrouter.HandleFunc("/sales", s.hGetSeles).Methods(GET)
-	managersSubrouter.HandleFunc("/sales", s.hMakeSeles).Methods(POST)
-	managersSubrouter.HandleFunc("/products", s.pass).Methods(GET)
-	managersSubrouter.HandleFunc("/products", s.hChProduct).Methods(POST)
-	managersSubrouter.HandleFunc("/customers", s.pass).Methods(GET)
-	managersSubrouter.HandleFunc("/customers", s.pass).Methods(POST)
-	managersSubrouter.HandleFunc("/customers/{id}", s.pass).Methods(DELETE)
+	managersSubrouter.Use(limit)
+	managersSubrouter.HandleFunc("/token", s.audited("login", audit.KindManager, s.apiTokenManager)).Methods(POST)
+	managersSubrouter.HandleFunc("/token/refresh", s.audited("token.refresh", audit.KindManager, s.hManagerRefresh)).Methods(POST)
+	managersSubrouter.HandleFunc("/token/2fa", s.audited("login.2fa", audit.KindManager, s.hManagerTwoFactor)).Methods(POST)
+	managersSubrouter.HandleFunc("/password/reset", s.audited("password.reset.request", audit.KindManager, s.hManagerRequestReset)).Methods(POST)
+	managersSubrouter.HandleFunc("/password/reset/confirm", s.audited("password.reset", audit.KindManager, s.hManagerConfirmReset)).Methods(POST)
+
+	// staff edit customers under the customers prefix, authenticated as managers
+	customersStaffSubRouter := s.mux.PathPrefix("/api/customers").Subrouter()
+	customersStaffSubRouter.Use(ipLimit, s.auditedAuth(audit.KindManager), managersAythMd, limit)
+	customersStaffSubRouter.Handle("/{id:[0-9]+}", s.audited("customer.update", audit.KindManager, managersRoute(s.handlePatchCustomer, security.ScopeCustomersWrite, staff...))).Methods(PATCH)
+	customersStaffSubRouter.Handle("/{id:[0-9]+}/block", s.audited("customer.block", audit.KindManager, managersRoute(s.handleBlockByID, security.ScopeCustomersWrite, staff...))).Methods(POST)
+	customersStaffSubRouter.Handle("/{id:[0-9]+}/block", s.audited("customer.unblock", audit.KindManager, managersRoute(s.handleUnBlockByID, security.ScopeCustomersWrite, staff...))).Methods(DELETE)
+
+	managersAuthSubrouter := s.mux.PathPrefix("/api/managers").Subrouter()
+	managersAuthSubrouter.Use(ipLimit, s.auditedAuth(audit.KindManager), managersAythMd, limit)
+	managersAuthSubrouter.Handle("/logout", s.audited("logout", audit.KindManager, managersRoute(s.hManagerLogout, ""))).Methods(POST)
+	managersAuthSubrouter.Handle("/logout/all", s.audited("logout.all", audit.KindManager, managersRoute(s.hManagerLogoutAll, ""))).Methods(POST)
+	managersAuthSubrouter.Handle("/sessions", managersRoute(s.hManagerSessions, "")).Methods(GET)
+	managersAuthSubrouter.Handle("/me", managersRoute(s.hGetManagerMe, "")).Methods(GET)
+	managersAuthSubrouter.Handle("/{id:[0-9]+}", managersRoute(s.hGetManager, "", admin...)).Methods(GET)
+	managersAuthSubrouter.Handle("/password", s.audited("password.change", audit.KindManager, managersRoute(s.hManagerChangePassword, ""))).Methods(POST)
+	managersAuthSubrouter.Handle("/2fa/enroll", s.audited("2fa.enroll", audit.KindManager, managersRoute(s.hManagerEnrollTOTP, ""))).Methods(POST)
+	managersAuthSubrouter.Handle("/2fa/confirm", s.audited("2fa.confirm", audit.KindManager, managersRoute(s.hManagerConfirmTOTP, ""))).Methods(POST)
+	managersAuthSubrouter.Handle("", s.audited("manager.register", audit.KindManager, managersRoute(s.hManagerR, "", admin...))).Methods(POST)
+	managersAuthSubrouter.Handle("/token/validate", managersRoute(s.pass, "", staff...)).Methods(POST)
+	managersAuthSubrouter.Handle("/sales", managersRoute(s.hGetSeles, security.ScopeSalesRead, staff...)).Methods(GET)
+	managersAuthSubrouter.Handle("/sales", managersRoute(s.hMakeSeles, security.ScopeSalesWrite, staff...)).Methods(POST)
+	managersAuthSubrouter.Handle("/products", managersRoute(s.pass, security.ScopeProductsRead, staff...)).Methods(GET)
+	managersAuthSubrouter.Handle("/products", s.audited("product.save", audit.KindManager, managersRoute(s.hChProduct, security.ScopeProductsWrite, admin...))).Methods(POST)
+	managersAuthSubrouter.Handle("/customers", managersRoute(s.hGetCustomers, security.ScopeCustomersRead, staff...)).Methods(GET)
+	managersAuthSubrouter.Handle("/customers/{id:[0-9]+}", managersRoute(s.hGetCustomer, security.ScopeCustomersRead, staff...)).Methods(GET)
+	managersAuthSubrouter.Handle("/customers", managersRoute(s.pass, security.ScopeCustomersWrite, staff...)).Methods(POST)
+	managersAuthSubrouter.Handle("/customers/{id:[0-9]+}", s.audited("customer.delete", audit.KindManager, managersRoute(s.hDeleteCustomer, security.ScopeCustomersWrite, admin...))).Methods(DELETE)
+	managersAuthSubrouter.Handle("/customers/{id:[0-9]+}/restore", s.audited("customer.restore", audit.KindManager, managersRoute(s.hRestoreCustomer, security.ScopeCustomersWrite, admin...))).Methods(POST)
+	managersAuthSubrouter.Handle("/customers/{id:[0-9]+}/unlock", s.audited("customer.unlock", audit.KindManager, managersRoute(s.hUnlockCustomer, "", admin...))).Methods(POST)
+	managersAuthSubrouter.Handle("/{id:[0-9]+}/unlock", s.audited("manager.unlock", audit.KindManager, managersRoute(s.hUnlockManager, "", admin...))).Methods(POST)
+	managersAuthSubrouter.Handle("/api-keys", s.audited("api_key.create", audit.KindManager, managersRoute(s.hCreateAPIKey, "", admin...))).Methods(POST)
+	managersAuthSubrouter.Handle("/api-keys", managersRoute(s.hGetAPIKeys, "", admin...)).Methods(GET)
+	managersAuthSubrouter.Handle("/audit", managersRoute(s.hGetAuditEvents, "", admin...)).Methods(GET)
+	managersAuthSubrouter.Handle("/audit.csv", managersRoute(s.hExportAuditEvents, "", admin...)).Methods(GET)
+	managersAuthSubrouter.Handle("/api-keys/{id:[0-9]+}", s.audited("api_key.revoke", audit.KindManager, managersRoute(s.hRevokeAPIKey, "", admin...))).Methods(DELETE)
+	managersAuthSubrouter.Handle("/password-stats", managersRoute(s.hGetPasswordStats, "", admin...)).Methods(GET)
 }
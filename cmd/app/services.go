@@ -0,0 +1,80 @@
+package app
+
+import (
+	"context"
+
+	"github.com/SsSJKK/crud/pkg/audit"
+	"github.com/SsSJKK/crud/pkg/customers"
+	"github.com/SsSJKK/crud/pkg/managers"
+	"github.com/SsSJKK/crud/pkg/security"
+)
+
+// The server reaches the services through the interfaces below, they list what the
+// handlers use of the customers, managers, security and audit services so that tests
+// can serve requests without a database.
+
+type customersService interface {
+	APISave(ctx context.Context, customer *customers.Customer) (*customers.Customer, error)
+	ByID(ctx context.Context, id int64) (*customers.Customer, error)
+	ChangeActive(ctx context.Context, id int64, active bool) (*customers.Customer, error)
+	Delete(ctx context.Context, id int64, actorID int64) (*customers.Customer, error)
+	List(ctx context.Context, filter *customers.ListFilter) (*customers.Page, error)
+	MakePurchase(ctx context.Context, customerID int64, items []*customers.OrderItem) (*customers.Purchase, error)
+	Products(ctx context.Context) ([]*customers.Product, error)
+	Purchases(ctx context.Context, customerID int64) ([]*customers.Purchase, error)
+	Restore(ctx context.Context, id int64) (*customers.Customer, error)
+	Update(ctx context.Context, id int64, versions []int64, patch *customers.Patch) (*customers.Customer, error)
+}
+
+type managersService interface {
+	ByID(ctx context.Context, id int64) (*managers.Managers, error)
+	ChangeProduct(ctx context.Context, item *managers.Product) (*managers.Product, error)
+	GetSales(ctx context.Context, id int64) (int64, error)
+	HasAnyRole(ctx context.Context, roles ...string) bool
+	IDByToken(ctx context.Context, token string) (int64, error)
+	MakeSele(ctx context.Context, saleP *managers.SalePositions, idManager int64) (int64, error)
+	Registration(ctx context.Context, item *managers.Managers) (*managers.Managers, error)
+}
+
+type securityService interface {
+	APIKeys(ctx context.Context) ([]*security.APIKey, error)
+	AuthCustomer(ctx context.Context, phone, password string, client *security.Client) (int64, error)
+	AuthManager(ctx context.Context, phone, password string, client *security.Client) (int64, error)
+	AuthenticateAPIKey(ctx context.Context, key string, client *security.Client) (int64, []string, error)
+	AuthenticateCustomer(ctx context.Context, tkn string) (int64, error)
+	ChangeCustomerPassword(ctx context.Context, id int64, oldPassword, newPassword string) error
+	ChangeManagerPassword(ctx context.Context, id int64, oldPassword, newPassword string) error
+	CompleteManagerChallenge(ctx context.Context, challenge string, code string, client *security.Client) (*security.Token, []string, error)
+	ConfirmManagerTOTP(ctx context.Context, id int64, code string) ([]string, error)
+	CreateAPIKey(ctx context.Context, managerID int64, item *security.APIKey) (*security.APIKey, string, error)
+	CustomerClaims(ctx context.Context, token string) (int64, []string, error)
+	CustomerSessions(ctx context.Context, id int64, current string) ([]*security.Session, error)
+	EnrollManagerTOTP(ctx context.Context, id int64) (*security.Enrollment, error)
+	HashPassword(ctx context.Context, password string) (string, error)
+	ManagerClaims(ctx context.Context, token string) (int64, []string, error)
+	ManagerSessions(ctx context.Context, id int64, current string) ([]*security.Session, error)
+	PasswordStats(ctx context.Context) (map[string]*security.PasswordStats, error)
+	RefreshCustomerToken(ctx context.Context, refresh string, client *security.Client) (*security.Token, error)
+	RefreshManagerToken(ctx context.Context, refresh string, client *security.Client) (*security.Token, error)
+	RequestCustomerReset(ctx context.Context, phone string) error
+	RequestManagerReset(ctx context.Context, phone string) error
+	ResetCustomerPassword(ctx context.Context, phone, code, newPassword string) error
+	ResetManagerPassword(ctx context.Context, phone, code, newPassword string) error
+	RevokeAPIKey(ctx context.Context, id int64) error
+	RevokeCustomerToken(ctx context.Context, token string) error
+	RevokeCustomerTokens(ctx context.Context, id int64) error
+	RevokeManagerToken(ctx context.Context, token string) error
+	RevokeManagerTokens(ctx context.Context, id int64) error
+	Stateless() bool
+	TokenForCustomer(ctx context.Context, phone string, password string, client *security.Client) (*security.Token, error)
+	TokenForManager(ctx context.Context, phone string, password string, client *security.Client) (*security.Token, error)
+	TokenWithOut(ctx context.Context, id int64, client *security.Client) (*security.Token, error)
+	UnlockCustomer(ctx context.Context, id int64) error
+	UnlockManager(ctx context.Context, id int64) error
+}
+
+type auditService interface {
+	Events(ctx context.Context, filter *audit.Filter) (*audit.Page, error)
+	Export(ctx context.Context, filter *audit.Filter, fn func(event *audit.Event) error) error
+	Record(ctx context.Context, event *audit.Event) error
+}
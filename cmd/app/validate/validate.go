@@ -0,0 +1,184 @@
+package validate
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+	"github.com/SsSJKK/crud/pkg/phone"
+)
+
+// field error codes, apierror holds their messages
+const (
+	CodeRequired     = apierror.CodeRequired
+	CodeTooShort     = apierror.CodeTooShort
+	CodeTooLong      = apierror.CodeTooLong
+	CodeTooSmall     = apierror.CodeTooSmall
+	CodeTooLarge     = apierror.CodeTooLarge
+	CodeNotPositive  = apierror.CodeNotPositive
+	CodeInvalidPhone = apierror.CodeInvalidPhone
+	CodeNotAllowed   = apierror.CodeNotAllowed
+	CodeUnknownField = apierror.CodeUnknownField
+	CodeInvalidType  = apierror.CodeInvalidType
+)
+
+//Struct checks the `validate` tags of a struct (or a pointer to one) and returns
+//an error for every field that breaks a rule, fields are named by their json tags;
+//rules are comma separated: required, min=N, max=N (length for strings and slices,
+//value for numbers), gt=N, phone (anything phone.Normalize accepts), oneof=A B C;
+//slices of structs are checked element by element
+func Struct(value interface{}) []apierror.FieldError {
+	var errs []apierror.FieldError
+	check(reflect.ValueOf(value), "", &errs)
+	return errs
+}
+
+func check(v reflect.Value, prefix string, errs *[]apierror.FieldError) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = field.Name
+		}
+		name = prefix + name
+		value := v.Field(i)
+
+		if code := checkRules(value, field.Tag.Get("validate")); code != "" {
+			*errs = append(*errs, apierror.FieldError{Field: name, Code: code})
+			continue
+		}
+
+		elem := value
+		for elem.Kind() == reflect.Ptr && !elem.IsNil() {
+			elem = elem.Elem()
+		}
+		switch elem.Kind() {
+		case reflect.Struct:
+			check(elem, name+".", errs)
+		case reflect.Slice:
+			for j := 0; j < elem.Len(); j++ {
+				check(elem.Index(j), name+"["+strconv.Itoa(j)+"].", errs)
+			}
+		}
+	}
+}
+
+// checkRules returns the code of the first broken rule, or ""
+func checkRules(value reflect.Value, tag string) string {
+	if tag == "" {
+		return ""
+	}
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			if strings.Contains(","+tag+",", ",required,") {
+				return CodeRequired
+			}
+			return ""
+		}
+		value = value.Elem()
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		kv := strings.SplitN(rule, "=", 2)
+		arg := ""
+		if len(kv) == 2 {
+			arg = kv[1]
+		}
+		switch kv[0] {
+		case "required":
+			if value.IsZero() || (value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "") {
+				return CodeRequired
+			}
+		case "min":
+			if n, ok := measure(value); ok && n < parse(arg) {
+				if isNumber(value) {
+					return CodeTooSmall
+				}
+				return CodeTooShort
+			}
+		case "max":
+			if n, ok := measure(value); ok && n > parse(arg) {
+				if isNumber(value) {
+					return CodeTooLarge
+				}
+				return CodeTooLong
+			}
+		case "gt":
+			if n, ok := measure(value); ok && isNumber(value) && n <= parse(arg) {
+				return CodeNotPositive
+			}
+		case "phone":
+			if value.Kind() == reflect.String && !phone.Valid(value.String()) {
+				return CodeInvalidPhone
+			}
+		case "oneof":
+			allowed := strings.Fields(arg)
+			if value.Kind() == reflect.String && !contains(allowed, value.String()) {
+				return CodeNotAllowed
+			}
+			if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String {
+				for j := 0; j < value.Len(); j++ {
+					if !contains(allowed, value.Index(j).String()) {
+						return CodeNotAllowed
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// measure is the length of strings and slices and the value of numbers
+func measure(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String())), true
+	case reflect.Slice, reflect.Map:
+		return float64(value.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	}
+	return 0, false
+}
+
+func isNumber(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return false
+	}
+	return true
+}
+
+func parse(arg string) float64 {
+	n, _ := strconv.ParseFloat(arg, 64)
+	return n
+}
+
+func contains(items []string, item string) bool {
+	for _, v := range items {
+		if v == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package validate
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/SsSJKK/crud/cmd/app/apierror"
+)
+
+type position struct {
+	ProductID int64 `json:"product_id" validate:"gt=0"`
+	Qty       int64 `json:"qty" validate:"gt=0,max=10"`
+}
+
+type request struct {
+	Name      string      `json:"name" validate:"required,min=2,max=5"`
+	Phone     string      `json:"phone,omitempty" validate:"phone"`
+	Role      string      `json:"role" validate:"oneof=ADMIN MANAGER"`
+	Roles     []string    `json:"roles" validate:"oneof=ADMIN MANAGER"`
+	Price     float64     `json:"price" validate:"min=1,max=100"`
+	Nick      *string     `json:"nick" validate:"min=1,max=3"`
+	Email     *string     `json:"email" validate:"required"`
+	Positions []*position `json:"positions" validate:"max=2"`
+	Owner     *position   `json:"owner"`
+	Internal  string      `validate:"required"`
+	secret    string      `validate:"required"`
+}
+
+// valid returns a request that breaks no rule, tests spoil one field of it
+func valid() *request {
+	nick, email := "Ann", "ann@example.com"
+	return &request{
+		Name:      "Ann",
+		Phone:     "+992927776655",
+		Role:      "ADMIN",
+		Roles:     []string{"ADMIN", "MANAGER"},
+		Price:     10,
+		Nick:      &nick,
+		Email:     &email,
+		Positions: []*position{{ProductID: 1, Qty: 1}},
+		Owner:     &position{ProductID: 1, Qty: 1},
+		Internal:  "x",
+	}
+}
+
+func TestStruct(t *testing.T) {
+	empty, long := "", "Anna"
+	tests := []struct {
+		name  string
+		spoil func(item *request)
+		want  []apierror.FieldError
+	}{
+		{"valid", func(item *request) {}, nil},
+		{"required empty", func(item *request) { item.Name = "" }, []apierror.FieldError{{Field: "name", Code: CodeRequired}}},
+		{"required blank", func(item *request) { item.Name = "   " }, []apierror.FieldError{{Field: "name", Code: CodeRequired}}},
+		{"min length", func(item *request) { item.Name = "A" }, []apierror.FieldError{{Field: "name", Code: CodeTooShort}}},
+		{"min counts runes", func(item *request) { item.Name = "Ёж" }, nil},
+		{"max length", func(item *request) { item.Name = "Annabel" }, []apierror.FieldError{{Field: "name", Code: CodeTooLong}}},
+		{"min value", func(item *request) { item.Price = 0.5 }, []apierror.FieldError{{Field: "price", Code: CodeTooSmall}}},
+		{"max value", func(item *request) { item.Price = 100.5 }, []apierror.FieldError{{Field: "price", Code: CodeTooLarge}}},
+		{"phone", func(item *request) { item.Phone = "+0123456789" }, []apierror.FieldError{{Field: "phone", Code: CodeInvalidPhone}}},
+		{"oneof", func(item *request) { item.Role = "OWNER" }, []apierror.FieldError{{Field: "role", Code: CodeNotAllowed}}},
+		{"oneof slice", func(item *request) { item.Roles = []string{"ADMIN", "OWNER"} }, []apierror.FieldError{{Field: "roles", Code: CodeNotAllowed}}},
+		{"nil pointer skips rules", func(item *request) { item.Nick = nil }, nil},
+		{"pointer min", func(item *request) { item.Nick = &empty }, []apierror.FieldError{{Field: "nick", Code: CodeTooShort}}},
+		{"pointer max", func(item *request) { item.Nick = &long }, []apierror.FieldError{{Field: "nick", Code: CodeTooLong}}},
+		{"pointer required", func(item *request) { item.Email = nil }, []apierror.FieldError{{Field: "email", Code: CodeRequired}}},
+		{"pointer required empty", func(item *request) { item.Email = &empty }, []apierror.FieldError{{Field: "email", Code: CodeRequired}}},
+		{"slice max", func(item *request) { item.Positions = make([]*position, 3) }, []apierror.FieldError{{Field: "positions", Code: CodeTooLong}}},
+		{"nested slice", func(item *request) {
+			item.Positions = []*position{{ProductID: 1, Qty: 1}, {ProductID: 0, Qty: 11}}
+		}, []apierror.FieldError{{Field: "positions[1].product_id", Code: CodeNotPositive}, {Field: "positions[1].qty", Code: CodeTooLarge}}},
+		{"nil slice element", func(item *request) { item.Positions = []*position{nil} }, nil},
+		{"nested struct", func(item *request) { item.Owner.Qty = -1 }, []apierror.FieldError{{Field: "owner.qty", Code: CodeNotPositive}}},
+		{"field without json tag", func(item *request) { item.Internal = "" }, []apierror.FieldError{{Field: "Internal", Code: CodeRequired}}},
+		{"unexported field", func(item *request) { item.secret = "" }, nil},
+		{"several fields", func(item *request) {
+			item.Name, item.Role = "", "OWNER"
+		}, []apierror.FieldError{{Field: "name", Code: CodeRequired}, {Field: "role", Code: CodeNotAllowed}}},
+	}
+	for _, tt := range tests {
+		item := valid()
+		tt.spoil(item)
+		got := Struct(item)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStructNotAStruct(t *testing.T) {
+	var item *request
+	for _, value := range []interface{}{nil, item, 42, "name", []request{{}}} {
+		if got := Struct(value); got != nil {
+			t.Errorf("Struct(%#v) = %v, want nil", value, got)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/customers"
+	"github.com/SsSJKK/crud/pkg/managers"
+)
+
+// Responses never encode service types directly: every field that goes out is listed
+// in a view below, and none of the views has a place for a password hash.
+
+// customerPublicView is what anyone may see of a customer
+type customerPublicView struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func newCustomerPublicView(item *customers.Customer) *customerPublicView {
+	return &customerPublicView{ID: item.ID, Name: item.Name}
+}
+
+// customerView is what staff and the customer themselves see
+type customerView struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Phone   string    `json:"phone"`
+	Active  bool      `json:"active"`
+	Created time.Time `json:"created"`
+}
+
+func newCustomerView(item *customers.Customer) *customerView {
+	return &customerView{
+		ID:      item.ID,
+		Name:    item.Name,
+		Phone:   item.Phone,
+		Active:  item.Active,
+		Created: item.Created,
+	}
+}
+
+// customerPageView is a customers.Page with every item passed through a view
+type customerPageView struct {
+	Items      []interface{} `json:"items"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Total      int64         `json:"total"`
+	Limit      int           `json:"limit"`
+}
+
+func newCustomerPageView(page *customers.Page, view func(item *customers.Customer) interface{}) *customerPageView {
+	items := make([]interface{}, 0, len(page.Items))
+	for _, item := range page.Items {
+		items = append(items, view(item))
+	}
+	return &customerPageView{Items: items, NextCursor: page.NextCursor, Total: page.Total, Limit: page.Limit}
+}
+
+func publicCustomer(item *customers.Customer) interface{} {
+	return newCustomerPublicView(item)
+}
+
+func staffCustomer(item *customers.Customer) interface{} {
+	return newCustomerView(item)
+}
+
+// managerView is what admins and the manager themselves see
+type managerView struct {
+	ID      int64     `json:"id"`
+	Name    string    `json:"name"`
+	Phone   string    `json:"phone"`
+	Roles   []string  `json:"roles"`
+	Active  bool      `json:"active"`
+	Created time.Time `json:"created"`
+}
+
+func newManagerView(item *managers.Managers) *managerView {
+	return &managerView{
+		ID:      item.ID,
+		Name:    item.Name,
+		Phone:   item.Phone,
+		Roles:   item.Roles,
+		Active:  item.Active,
+		Created: item.Created,
+	}
+}
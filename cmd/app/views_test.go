@@ -0,0 +1,313 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SsSJKK/crud/cmd/app/middleware"
+	"github.com/SsSJKK/crud/pkg/audit"
+	"github.com/SsSJKK/crud/pkg/customers"
+	"github.com/SsSJKK/crud/pkg/managers"
+	"github.com/SsSJKK/crud/pkg/security"
+	"github.com/SsSJKK/crud/pkg/stock"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// hashPrefixes start the hashes of every supported algorithm
+var hashPrefixes = []string{"$2a$", "$argon2id$"}
+
+// fakeCustomers answers every call with the stored customer, hash and all
+type fakeCustomers struct {
+	customersService
+	items []*customers.Customer
+}
+
+func (f *fakeCustomers) first() *customers.Customer {
+	item := *f.items[0]
+	return &item
+}
+
+// phoneInUse tells whether a customer other than id has the phone, as the unique index would
+func (f *fakeCustomers) phoneInUse(id int64, phone string) bool {
+	for _, item := range f.items {
+		if item.ID != id && item.Phone == phone {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeCustomers) APISave(ctx context.Context, customer *customers.Customer) (*customers.Customer, error) {
+	if f.phoneInUse(0, customer.Phone) {
+		return nil, customers.ErrPhoneInUse
+	}
+	item := f.first()
+	item.Name, item.Phone, item.Password = customer.Name, customer.Phone, customer.Password
+	return item, nil
+}
+
+func (f *fakeCustomers) ByID(ctx context.Context, id int64) (*customers.Customer, error) {
+	return f.first(), nil
+}
+
+func (f *fakeCustomers) ChangeActive(ctx context.Context, id int64, active bool) (*customers.Customer, error) {
+	item := f.first()
+	item.Active = active
+	return item, nil
+}
+
+func (f *fakeCustomers) Delete(ctx context.Context, id int64, actorID int64) (*customers.Customer, error) {
+	return f.first(), nil
+}
+
+func (f *fakeCustomers) List(ctx context.Context, filter *customers.ListFilter) (*customers.Page, error) {
+	return &customers.Page{Items: f.items, Total: int64(len(f.items)), Limit: customers.DefaultLimit}, nil
+}
+
+func (f *fakeCustomers) Restore(ctx context.Context, id int64) (*customers.Customer, error) {
+	return f.first(), nil
+}
+
+func (f *fakeCustomers) Update(ctx context.Context, id int64, versions []int64, patch *customers.Patch) (*customers.Customer, error) {
+	if patch.Phone != nil && f.phoneInUse(id, *patch.Phone) {
+		return nil, customers.ErrPhoneInUse
+	}
+	item := f.first()
+	if patch.Name != nil {
+		item.Name = *patch.Name
+	}
+	item.Version++
+	return item, nil
+}
+
+type fakeManagers struct {
+	managersService
+	item *managers.Managers
+}
+
+func (f *fakeManagers) ByID(ctx context.Context, id int64) (*managers.Managers, error) {
+	item := *f.item
+	return &item, nil
+}
+
+func (f *fakeManagers) HasAnyRole(ctx context.Context, roles ...string) bool {
+	return true
+}
+
+// MakeSele sells products 1 to 10 and knows no other ones
+func (f *fakeManagers) MakeSele(ctx context.Context, saleP *managers.SalePositions, idManager int64) (int64, error) {
+	var unknown []int64
+	for _, v := range saleP.Positions {
+		if v.ProductID > 10 {
+			unknown = append(unknown, v.ProductID)
+		}
+	}
+	if len(unknown) != 0 {
+		return 0, &stock.ErrUnknownProducts{ProductIDs: unknown}
+	}
+	return 42, nil
+}
+
+func (f *fakeManagers) IDByToken(ctx context.Context, token string) (int64, error) {
+	if token != "manager" {
+		return 0, security.ErrInvalidToken
+	}
+	return f.item.ID, nil
+}
+
+// fakeSecurity hashes for real and fakes whatever needs the database
+type fakeSecurity struct {
+	*security.Service
+}
+
+func (f *fakeSecurity) AuthenticateAPIKey(ctx context.Context, key string, client *security.Client) (int64, []string, error) {
+	return 0, nil, security.ErrInvalidToken
+}
+
+func (f *fakeSecurity) CustomerClaims(ctx context.Context, token string) (int64, []string, error) {
+	switch token {
+	case "customer":
+		return 1, nil, nil
+	case "expired":
+		return 0, nil, security.ErrExpireToken
+	}
+	return 0, nil, security.ErrInvalidToken
+}
+
+func (f *fakeSecurity) RevokeCustomerTokens(ctx context.Context, id int64) error {
+	return nil
+}
+
+type fakeAudit struct {
+	auditService
+	events []*audit.Event
+}
+
+func (f *fakeAudit) Record(ctx context.Context, event *audit.Event) error {
+	f.events = append(f.events, event)
+	return nil
+}
+
+func newTestServer(t *testing.T) *Server {
+	bcryptHasher := security.NewService(nil, &security.Config{Password: security.PasswordParams{
+		Algorithm:  security.AlgorithmBcrypt,
+		BcryptCost: bcrypt.MinCost,
+	}}, nil)
+	argon2Hasher := security.NewService(nil, &security.Config{Password: security.PasswordParams{
+		Algorithm:     security.AlgorithmArgon2id,
+		Argon2Time:    1,
+		Argon2Memory:  1024,
+		Argon2Threads: 1,
+	}}, nil)
+	bcryptHash, err := bcryptHasher.HashPassword(context.Background(), "bcrypt password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := argon2Hasher.HashPassword(context.Background(), "argon2 password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	customersSvc := &fakeCustomers{items: []*customers.Customer{
+		{ID: 1, Name: "Bcrypt", Phone: "+992927776655", Password: bcryptHash, Active: true, Created: created, Version: 1},
+		{ID: 2, Name: "Argon2", Phone: "+992927776656", Password: argon2Hash, Active: true, Created: created, Version: 1},
+	}}
+	managersSvc := &fakeManagers{item: &managers.Managers{
+		ID:       1,
+		Name:     "Admin",
+		Phone:    "+992927776657",
+		Password: argon2Hash,
+		Roles:    []string{managers.RoleAdmin},
+		Active:   true,
+		Created:  created,
+	}}
+
+	s := &Server{
+		mux:          mux.NewRouter(),
+		config:       &Config{},
+		customersSvc: customersSvc,
+		securitySvc:  &fakeSecurity{Service: argon2Hasher},
+		managersSvc:  managersSvc,
+		auditSvc:     &fakeAudit{},
+		limitStore:   middleware.NewMemoryStore(),
+	}
+	s.Init()
+	return s
+}
+
+// assertNoSecrets fails when body has a password member at any depth or anything like a hash
+func assertNoSecrets(t *testing.T, name string, body []byte) {
+	t.Helper()
+	for _, prefix := range hashPrefixes {
+		if strings.Contains(string(body), prefix) {
+			t.Errorf("%s: body has a %s hash: %s", name, prefix, body)
+		}
+	}
+	var value interface{}
+	err := json.Unmarshal(body, &value)
+	if err != nil {
+		t.Errorf("%s: %v: %s", name, err, body)
+		return
+	}
+	if hasKey(value, "password") {
+		t.Errorf("%s: body has a password member: %s", name, body)
+	}
+}
+
+func hasKey(value interface{}, key string) bool {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			if strings.EqualFold(k, key) || hasKey(v, key) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, v := range value {
+			if hasKey(v, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestViewsHidePasswords(t *testing.T) {
+	s := newTestServer(t)
+	customersSvc := s.customersSvc.(*fakeCustomers)
+	managersSvc := s.managersSvc.(*fakeManagers)
+	page, err := customersSvc.List(context.Background(), &customers.ListFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	views := map[string]interface{}{
+		"customerPublicView": newCustomerPublicView(customersSvc.items[0]),
+		"customerView":       newCustomerView(customersSvc.items[1]),
+		"public page":        newCustomerPageView(page, publicCustomer),
+		"staff page":         newCustomerPageView(page, staffCustomer),
+		"managerView":        newManagerView(managersSvc.item),
+	}
+	for name, view := range views {
+		body, err := json.Marshal(view)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertNoSecrets(t, name, body)
+	}
+}
+
+func TestHandlersHidePasswords(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		auth   string
+		body   string
+	}{
+		{GET, "/api/customers", "", ""},
+		{GET, "/api/customers/active", "", ""},
+		{GET, "/api/customers/1", "", ""},
+		{POST, "/api/customers", "", `{"name": "New", "phone": "+992927776658", "password": "correct horse battery"}`},
+		{GET, "/api/customers/me", "customer", ""},
+		{PATCH, "/api/customers/me", "customer", `{"name": "Me"}`},
+		{PATCH, "/api/customers/1", "manager", `{"name": "Staff"}`},
+		{POST, "/api/customers/1/block", "manager", ""},
+		{DELETE, "/api/customers/1/block", "manager", ""},
+		{GET, "/api/managers/me", "manager", ""},
+		{GET, "/api/managers/1", "manager", ""},
+		{GET, "/api/managers/customers", "manager", ""},
+		{GET, "/api/managers/customers/1", "manager", ""},
+		{DELETE, "/api/managers/customers/1", "manager", ""},
+		{POST, "/api/managers/customers/1/restore", "manager", ""},
+	}
+	for _, tt := range tests {
+		name := tt.method + " " + tt.path
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if tt.body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		if tt.method == PATCH {
+			r.Header.Set("If-Match", `"1"`)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", name, w.Code, w.Body)
+			continue
+		}
+		assertNoSecrets(t, name, w.Body.Bytes())
+	}
+}
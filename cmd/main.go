@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/SsSJKK/crud/pkg/managers"
 
 	"github.com/SsSJKK/crud/cmd/app"
+	"github.com/SsSJKK/crud/cmd/app/middleware"
+	"github.com/SsSJKK/crud/pkg/audit"
 	"github.com/SsSJKK/crud/pkg/customers"
+	"github.com/SsSJKK/crud/pkg/notify"
+	"github.com/SsSJKK/crud/pkg/phone"
 	"github.com/SsSJKK/crud/pkg/security"
 	"github.com/gorilla/mux"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"go.uber.org/dig"
+	"golang.org/x/crypto/bcrypt"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
@@ -31,14 +39,25 @@ func main() {
 }
 
 func execute(host string, port string, dsn string) (err error) {
+	// PHONE_REGION is the country of numbers written without a country code
+	if region := os.Getenv("PHONE_REGION"); region != "" {
+		err = phone.SetDefaultRegion(region)
+		if err != nil {
+			return err
+		}
+	}
+
 	deps := []interface{}{
 		app.NewServer,
+		serverConfig,
 		mux.NewRouter,
 		func() (*pgxpool.Pool, error) {
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*5)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
 			return pgxpool.Connect(ctx, dsn)
 		},
 		customers.NewService,
+		audit.NewService,
 		managers.NewService,
 		func(server *app.Server) *http.Server {
 			return &http.Server{
@@ -46,9 +65,12 @@ func execute(host string, port string, dsn string) (err error) {
 				Handler: server,
 			}
 		},
-		
+		securityConfig,
+		notifierConfig,
 		security.NewService,
-		
+		func() middleware.LimitStore {
+			return middleware.NewMemoryStore()
+		},
 	}
 
 	container := dig.New()
@@ -67,7 +89,169 @@ func execute(host string, port string, dsn string) (err error) {
 		return err
 	}
 
+	err = container.Invoke(func(customersSvc *customers.Service) error {
+		retention, interval, err := purgeConfig()
+		if err != nil {
+			return err
+		}
+		if retention > 0 {
+			go purgeCustomers(customersSvc, retention, interval)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
 	return container.Invoke(func(server *http.Server) error {
 		return server.ListenAndServe()
 	})
 }
+
+// securityConfig reads the token mode from the environment:
+// TOKEN_MODE=jwt enables signed tokens, JWT_KEYS="kid:secret,kid:secret", JWT_KID=kid,
+// TWO_FACTOR_ROLES="ADMIN" requires TOTP for managers with any of these roles,
+// PASSWORD_ALGORITHM=bcrypt|argon2id with BCRYPT_COST or ARGON2_TIME, ARGON2_MEMORY (KiB), ARGON2_THREADS
+// set how new password hashes are made
+func securityConfig() (*security.Config, error) {
+	config := &security.Config{Keys: make(map[string][]byte)}
+	password, err := passwordParams()
+	if err != nil {
+		return nil, err
+	}
+	config.Password = password
+	if roles := os.Getenv("TWO_FACTOR_ROLES"); roles != "" {
+		config.TwoFactorRoles = strings.Split(roles, ",")
+	}
+	if os.Getenv("TOKEN_MODE") != "jwt" {
+		return config, nil
+	}
+	config.Stateless = true
+	config.KeyID = os.Getenv("JWT_KID")
+	for _, pair := range strings.Split(os.Getenv("JWT_KEYS"), ",") {
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			continue
+		}
+		config.Keys[kv[0]] = []byte(kv[1])
+	}
+	if _, ok := config.Keys[config.KeyID]; !ok {
+		return nil, errors.New("JWT_KID is not among JWT_KEYS")
+	}
+	return config, nil
+}
+
+func passwordParams() (security.PasswordParams, error) {
+	params := security.DefaultPasswordParams()
+	if algorithm := os.Getenv("PASSWORD_ALGORITHM"); algorithm != "" {
+		params.Algorithm = algorithm
+	}
+	if params.Algorithm != security.AlgorithmBcrypt && params.Algorithm != security.AlgorithmArgon2id {
+		return params, errors.New("PASSWORD_ALGORITHM must be bcrypt or argon2id")
+	}
+
+	cost, err := envUint("BCRYPT_COST", uint64(params.BcryptCost), 8)
+	if err != nil {
+		return params, err
+	}
+	if int(cost) < bcrypt.MinCost || int(cost) > bcrypt.MaxCost {
+		return params, errors.New("BCRYPT_COST is out of range")
+	}
+	params.BcryptCost = int(cost)
+
+	passes, err := envUint("ARGON2_TIME", uint64(params.Argon2Time), 32)
+	if err != nil {
+		return params, err
+	}
+	memory, err := envUint("ARGON2_MEMORY", uint64(params.Argon2Memory), 32)
+	if err != nil {
+		return params, err
+	}
+	threads, err := envUint("ARGON2_THREADS", uint64(params.Argon2Threads), 8)
+	if err != nil {
+		return params, err
+	}
+	if passes == 0 || threads == 0 {
+		return params, errors.New("ARGON2_TIME and ARGON2_THREADS must be positive")
+	}
+	params.Argon2Time, params.Argon2Memory, params.Argon2Threads = uint32(passes), uint32(memory), uint8(threads)
+	return params, nil
+}
+
+func envUint(name string, def uint64, bits int) (uint64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(value, 10, bits)
+	if err != nil {
+		return 0, errors.New(name + " must be a number")
+	}
+	return n, nil
+}
+
+// purgeConfig reads CUSTOMER_RETENTION_DAYS, how long deleted customers keep their
+// personal data (0 turns the purge off), and CUSTOMER_PURGE_INTERVAL_MINUTES
+func purgeConfig() (time.Duration, time.Duration, error) {
+	days, err := envUint("CUSTOMER_RETENTION_DAYS", 90, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	minutes, err := envUint("CUSTOMER_PURGE_INTERVAL_MINUTES", 60, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if minutes == 0 {
+		return 0, 0, errors.New("CUSTOMER_PURGE_INTERVAL_MINUTES must be positive")
+	}
+	return time.Duration(days) * 24 * time.Hour, time.Duration(minutes) * time.Minute, nil
+}
+
+// purgeCustomers anonymizes customers whose retention has run out, every interval
+func purgeCustomers(customersSvc *customers.Service, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := customersSvc.Purge(context.Background(), retention)
+		if err != nil {
+			log.Println(err)
+		} else if n > 0 {
+			log.Printf("purged %d deleted customers", n)
+		}
+		<-ticker.C
+	}
+}
+
+// notifierConfig reads NOTIFIER, how one-time codes reach the users: webhook posts them
+// to NOTIFY_WEBHOOK_URL; log prints them to stdout for local testing and must be chosen
+// explicitly, with no NOTIFIER the server refuses to start
+func notifierConfig() (notify.Notifier, error) {
+	switch os.Getenv("NOTIFIER") {
+	case "webhook":
+		url := os.Getenv("NOTIFY_WEBHOOK_URL")
+		if url == "" {
+			return nil, errors.New("NOTIFY_WEBHOOK_URL is required with NOTIFIER=webhook")
+		}
+		return notify.NewWebhookNotifier(url), nil
+	case "log":
+		log.Print("NOTIFIER=log: one-time codes are printed to stdout, not sent")
+		return notify.NewLogNotifier(os.Stdout), nil
+	case "":
+		return nil, errors.New("NOTIFIER must be set to webhook, or to log for local testing")
+	}
+	return nil, errors.New("NOTIFIER must be webhook or log")
+}
+
+// serverConfig reads BASIC_AUTH="customers,managers" to accept Basic auth on those routes
+func serverConfig() *app.Config {
+	config := &app.Config{}
+	for _, name := range strings.Split(os.Getenv("BASIC_AUTH"), ",") {
+		switch strings.TrimSpace(name) {
+		case "customers":
+			config.BasicCustomers = true
+		case "managers":
+			config.BasicManagers = true
+		}
+	}
+	return config
+}
@@ -1,11 +1,19 @@
 CREATE TABLE customers (
     id BIGSERIAL PRIMARY KEY,
     name TEXT NOT NULL,
-    phone TEXT NOT NULL UNIQUE,
+    phone TEXT NOT NULL,
     password TEXT NOT NULL,
     active BOOLEAN NOT NULL DEFAULT TRUE,
-    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    deleted TIMESTAMP,
+    deleted_by BIGINT,
+    anonymized TIMESTAMP,
+    version BIGINT NOT NULL DEFAULT 1
 );
+CREATE UNIQUE INDEX customers_phone_idx ON customers (phone) WHERE deleted IS NULL;
+CREATE INDEX customers_deleted_idx ON customers (deleted) WHERE anonymized IS NULL;
+CREATE INDEX customers_created_idx ON customers (created, id);
+CREATE INDEX customers_name_idx ON customers (name, id);
 CREATE TABLE managers (
     id BIGSERIAL PRIMARY KEY,
     name TEXT NOT NULL,
@@ -13,19 +21,40 @@ CREATE TABLE managers (
     password text not NULL,
     roles text [] NOT NULL DEFAULT '{}',
     active BOOLEAN not NULL DEFAULT TRUE,
-    creatred TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+    creatred TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    totp_secret TEXT,
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_step BIGINT NOT NULL DEFAULT 0
 );
 CREATE TABLE managers_tokens (
-    token TEXT not NULL UNIQUE,
+    id BIGSERIAL PRIMARY KEY,
+    token TEXT not NULL UNIQUE CHECK (length(token) = 64),
     manager_id BIGINT NOT NULL REFERENCES managers,
-    expire TIMESTAMP not null DEFAULT CURRENT_TIMESTAMP + INTERVAL '1 hour',
-    created TIMESTAMP not NULL DEFAULT CURRENT_TIMESTAMP
+    expire TIMESTAMP not null DEFAULT CURRENT_TIMESTAMP + INTERVAL '15 minutes',
+    refresh TEXT UNIQUE CHECK (length(refresh) = 64),
+    refresh_expire TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP + INTERVAL '30 days',
+    family TEXT NOT NULL DEFAULT '',
+    created TIMESTAMP not NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used TIMESTAMP,
+    refreshed TIMESTAMP,
+    revoked TIMESTAMP,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT ''
 );
 CREATE TABLE customers_tokens (
-    token TEXT not NULL UNIQUE,
-    customers_id BIGINT NOT NULL REFERENCES managers,
-    expire TIMESTAMP not null DEFAULT CURRENT_TIMESTAMP + INTERVAL '1 hour',
-    created TIMESTAMP not NULL DEFAULT CURRENT_TIMESTAMP
+    id BIGSERIAL PRIMARY KEY,
+    token TEXT not NULL UNIQUE CHECK (length(token) = 64),
+    customer_id BIGINT NOT NULL REFERENCES customers,
+    expire TIMESTAMP not null DEFAULT CURRENT_TIMESTAMP + INTERVAL '15 minutes',
+    refresh TEXT UNIQUE CHECK (length(refresh) = 64),
+    refresh_expire TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP + INTERVAL '30 days',
+    family TEXT NOT NULL DEFAULT '',
+    created TIMESTAMP not NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used TIMESTAMP,
+    refreshed TIMESTAMP,
+    revoked TIMESTAMP,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT ''
 );
 CREATE TABLE products (
     id BIGSERIAL PRIMARY KEY,
@@ -37,7 +66,7 @@ CREATE TABLE products (
 );
 CREATE TABLE sales (
     id BIGSERIAL PRIMARY KEY,
-    manager_id BIGINT NOT NULL REFERENCES managers,
+    manager_id BIGINT REFERENCES managers,
     customer_id BIGINT NOT NULL DEFAULT 0,
     crated TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
@@ -46,6 +75,60 @@ CREATE TABLE sale_positions (
     sale_id BIGINT NOT NULL REFERENCES sales,
     product_id BIGINT NOT NULL REFERENCES products,
     price INTEGER NOT NULL CHECK (price >= 0),
+    list_price INTEGER NOT NULL CHECK (list_price >= 0),
+    price_reason TEXT,
     qty INTEGER NOT NULL CHECK (qty > 0),
     created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
+CREATE TABLE password_resets (
+    id BIGSERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    user_id BIGINT NOT NULL,
+    code TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expire TIMESTAMP NOT NULL,
+    used TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE managers_challenges (
+    id BIGSERIAL PRIMARY KEY,
+    challenge TEXT NOT NULL UNIQUE,
+    manager_id BIGINT NOT NULL REFERENCES managers,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expire TIMESTAMP NOT NULL,
+    used TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE managers_recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    manager_id BIGINT NOT NULL REFERENCES managers,
+    code TEXT NOT NULL,
+    used TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    key TEXT NOT NULL UNIQUE,
+    manager_id BIGINT NOT NULL REFERENCES managers,
+    scopes TEXT [] NOT NULL DEFAULT '{}',
+    ip_allowlist TEXT [] NOT NULL DEFAULT '{}',
+    expire TIMESTAMP,
+    last_used TIMESTAMP,
+    revoked TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id BIGINT,
+    actor_kind TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    target TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    outcome TEXT NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX audit_events_created_idx ON audit_events (created);
+CREATE RULE audit_events_no_update AS ON UPDATE TO audit_events DO INSTEAD NOTHING;
+CREATE RULE audit_events_no_delete AS ON DELETE TO audit_events DO INSTEAD NOTHING;
@@ -0,0 +1,56 @@
+-- Sessions (id, last_used, revoked, user_agent, ip) and rotating refresh
+-- tokens (refresh, refresh_expire, family, refreshed) came before the
+-- migrations directory, databases created earlier lack their columns.
+ALTER TABLE managers_tokens
+    ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY,
+    ADD COLUMN IF NOT EXISTS last_used TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS revoked TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS refresh TEXT UNIQUE,
+    ADD COLUMN IF NOT EXISTS refresh_expire TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP + INTERVAL '30 days',
+    ADD COLUMN IF NOT EXISTS family TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS refreshed TIMESTAMP,
+    ALTER COLUMN expire SET DEFAULT CURRENT_TIMESTAMP + INTERVAL '15 minutes';
+
+ALTER TABLE customers_tokens
+    ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY,
+    ADD COLUMN IF NOT EXISTS last_used TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS revoked TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS refresh TEXT UNIQUE,
+    ADD COLUMN IF NOT EXISTS refresh_expire TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP + INTERVAL '30 days',
+    ADD COLUMN IF NOT EXISTS family TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS refreshed TIMESTAMP,
+    ALTER COLUMN expire SET DEFAULT CURRENT_TIMESTAMP + INTERVAL '15 minutes';
+
+-- Tokens are stored as SHA-256 hex digests from now on.
+-- Rows written before that hold plaintext tokens: they can no longer be
+-- matched by a lookup and must not stay in the database, so drop them.
+-- Every client will have to log in again.
+DELETE FROM managers_tokens WHERE length(token) <> 64;
+DELETE FROM customers_tokens WHERE length(token) <> 64;
+
+ALTER TABLE managers_tokens ADD CHECK (length(token) = 64);
+ALTER TABLE managers_tokens ADD CHECK (length(refresh) = 64);
+ALTER TABLE customers_tokens ADD CHECK (length(token) = 64);
+ALTER TABLE customers_tokens ADD CHECK (length(refresh) = 64);
+
+-- Customer tokens used to be keyed by customers_id pointing at managers, and
+-- sales always had a manager; customer purchases need both fixed. The tokens
+-- of the old shape were plaintext and are gone by now.
+DO $$
+BEGIN
+    IF EXISTS (SELECT FROM information_schema.columns
+        WHERE table_name = 'customers_tokens' AND column_name = 'customers_id') THEN
+        ALTER TABLE customers_tokens RENAME COLUMN customers_id TO customer_id;
+    END IF;
+END
+$$;
+ALTER TABLE customers_tokens DROP CONSTRAINT IF EXISTS customers_tokens_customers_id_fkey;
+ALTER TABLE customers_tokens DROP CONSTRAINT IF EXISTS customers_tokens_customer_id_fkey;
+DELETE FROM customers_tokens WHERE customer_id NOT IN (SELECT id FROM customers);
+ALTER TABLE customers_tokens ADD CONSTRAINT customers_tokens_customer_id_fkey
+    FOREIGN KEY (customer_id) REFERENCES customers;
+ALTER TABLE sales ALTER COLUMN manager_id DROP NOT NULL;
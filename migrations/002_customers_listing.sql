@@ -0,0 +1,3 @@
+-- Customer listings are paged by keyset on (sort field, id).
+CREATE INDEX customers_created_idx ON customers (created, id);
+CREATE INDEX customers_name_idx ON customers (name, id);
@@ -0,0 +1,10 @@
+-- Deleting a customer only marks the row, sales keep referencing it.
+-- A phone is unique among customers that are not deleted, so the same
+-- person can register again while the old row waits for the purge.
+ALTER TABLE customers ADD COLUMN deleted TIMESTAMP;
+ALTER TABLE customers ADD COLUMN deleted_by BIGINT;
+ALTER TABLE customers ADD COLUMN anonymized TIMESTAMP;
+
+ALTER TABLE customers DROP CONSTRAINT customers_phone_key;
+CREATE UNIQUE INDEX customers_phone_idx ON customers (phone) WHERE deleted IS NULL;
+CREATE INDEX customers_deleted_idx ON customers (deleted) WHERE anonymized IS NULL;
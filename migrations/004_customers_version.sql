@@ -0,0 +1,3 @@
+-- Every change of a customer bumps its version, it is sent as the ETag
+-- and PATCH applies only when If-Match still names the current one.
+ALTER TABLE customers ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
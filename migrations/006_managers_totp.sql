@@ -0,0 +1,23 @@
+-- TOTP two-factor login for managers: the secret, the pending login
+-- challenges after a correct password and the one-time recovery codes.
+ALTER TABLE managers
+    ADD COLUMN IF NOT EXISTS totp_secret TEXT,
+    ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS managers_challenges (
+    id BIGSERIAL PRIMARY KEY,
+    challenge TEXT NOT NULL UNIQUE,
+    manager_id BIGINT NOT NULL REFERENCES managers,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expire TIMESTAMP NOT NULL,
+    used TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS managers_recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    manager_id BIGINT NOT NULL REFERENCES managers,
+    code TEXT NOT NULL,
+    used TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
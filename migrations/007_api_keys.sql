@@ -0,0 +1,13 @@
+-- Scoped API keys for integrations, stored as digests.
+CREATE TABLE IF NOT EXISTS api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    key TEXT NOT NULL UNIQUE,
+    manager_id BIGINT NOT NULL REFERENCES managers,
+    scopes TEXT [] NOT NULL DEFAULT '{}',
+    ip_allowlist TEXT [] NOT NULL DEFAULT '{}',
+    expire TIMESTAMP,
+    last_used TIMESTAMP,
+    revoked TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,8 @@
+-- Sale positions keep the catalog price next to the charged one and the
+-- reason of an override. Positions sold before that were charged the price
+-- the client sent, it stands in for the list price.
+ALTER TABLE sale_positions
+    ADD COLUMN IF NOT EXISTS list_price INTEGER CHECK (list_price >= 0),
+    ADD COLUMN IF NOT EXISTS price_reason TEXT;
+UPDATE sale_positions SET list_price = price WHERE list_price IS NULL;
+ALTER TABLE sale_positions ALTER COLUMN list_price SET NOT NULL;
@@ -0,0 +1,223 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+//ErrInternal ...
+var ErrInternal = errors.New("internal error")
+
+// actor kinds
+const (
+	KindManager  = "manager"
+	KindCustomer = "customer"
+	KindAPIKey   = "api_key"
+)
+
+// outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeChallenge is a login that passed the password and waits for a second factor
+	OutcomeChallenge = "challenge"
+)
+
+//MaxLimit caps the page size of Events
+const MaxLimit = 500
+
+//Service ...
+type Service struct {
+	pool *pgxpool.Pool
+}
+
+//NewService ...
+func NewService(pool *pgxpool.Pool) *Service {
+	return &Service{pool: pool}
+}
+
+//Event ...
+type Event struct {
+	ID        int64     `json:"id"`
+	ActorID   *int64    `json:"actor_id"`
+	ActorKind string    `json:"actor_kind"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Outcome   string    `json:"outcome"`
+	Created   time.Time `json:"created"`
+}
+
+//Filter ...
+type Filter struct {
+	ActorID   *int64
+	ActorKind string
+	Action    string
+	Outcome   string
+	From      *time.Time
+	To        *time.Time
+	Limit     int
+	Offset    int
+}
+
+//Page ...
+type Page struct {
+	Items  []*Event `json:"items"`
+	Total  int64    `json:"total"`
+	Limit  int      `json:"limit"`
+	Offset int      `json:"offset"`
+}
+
+var eventContextKey = &contextKey{"audit event"}
+
+type contextKey struct {
+	name string
+}
+
+//WithEvent stores an event that handlers can fill in while serving a request
+func WithEvent(ctx context.Context, event *Event) context.Context {
+	return context.WithValue(ctx, eventContextKey, event)
+}
+
+//FromContext returns the event of the current request or a throwaway one
+func FromContext(ctx context.Context) *Event {
+	if event, ok := ctx.Value(eventContextKey).(*Event); ok {
+		return event
+	}
+	return &Event{}
+}
+
+//Record appends an event, there is no way to change or remove it afterwards
+func (s *Service) Record(ctx context.Context, event *Event) error {
+	err := s.pool.QueryRow(ctx, `INSERT INTO audit_events (actor_id, actor_kind, action, target, ip, user_agent, outcome)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created`,
+		event.ActorID,
+		event.ActorKind,
+		event.Action,
+		event.Target,
+		event.IP,
+		event.UserAgent,
+		event.Outcome,
+	).Scan(&event.ID, &event.Created)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+func (f *Filter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.Replace(condition, "?", "$"+strconv.Itoa(len(args)), 1))
+	}
+	if f.ActorID != nil {
+		add("actor_id = ?", *f.ActorID)
+	}
+	if f.ActorKind != "" {
+		add("actor_kind = ?", f.ActorKind)
+	}
+	if f.Action != "" {
+		add("action = ?", f.Action)
+	}
+	if f.Outcome != "" {
+		add("outcome = ?", f.Outcome)
+	}
+	if f.From != nil {
+		add("created >= ?", *f.From)
+	}
+	if f.To != nil {
+		add("created < ?", *f.To)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+//Events returns a page of events, newest first
+func (s *Service) Events(ctx context.Context, filter *Filter) (*Page, error) {
+	if filter.Limit <= 0 || filter.Limit > MaxLimit {
+		filter.Limit = MaxLimit
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+	where, args := filter.where()
+
+	page := &Page{Items: make([]*Event, 0), Limit: filter.Limit, Offset: filter.Offset}
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM audit_events`+where, args...).Scan(&page.Total)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+
+	args = append(args, filter.Limit, filter.Offset)
+	sqlSelect := `SELECT id, actor_id, actor_kind, action, target, ip, user_agent, outcome, created
+	FROM audit_events` + where + `
+	ORDER BY id DESC LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+	err = s.each(ctx, sqlSelect, args, func(event *Event) error {
+		page.Items = append(page.Items, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+//Export streams every event matching filter (limit and offset are ignored), oldest first
+func (s *Service) Export(ctx context.Context, filter *Filter, fn func(event *Event) error) error {
+	where, args := filter.where()
+	sqlSelect := `SELECT id, actor_id, actor_kind, action, target, ip, user_agent, outcome, created
+	FROM audit_events` + where + ` ORDER BY id`
+	return s.each(ctx, sqlSelect, args, fn)
+}
+
+func (s *Service) each(ctx context.Context, sqlSelect string, args []interface{}, fn func(event *Event) error) error {
+	rows, err := s.pool.Query(ctx, sqlSelect, args...)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := &Event{}
+		err = rows.Scan(
+			&event.ID,
+			&event.ActorID,
+			&event.ActorKind,
+			&event.Action,
+			&event.Target,
+			&event.IP,
+			&event.UserAgent,
+			&event.Outcome,
+			&event.Created,
+		)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return ErrInternal
+		}
+		err = fn(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package customers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+)
+
+//MaxLimit ...
+const MaxLimit = 500
+
+//DefaultLimit ...
+const DefaultLimit = 50
+
+//ErrInvalidSort ...
+var ErrInvalidSort = errors.New("invalid sort field")
+
+//ErrInvalidCursor ...
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// sortColumns whitelists the fields a listing can be sorted by
+var sortColumns = map[string]string{
+	"id":      "id",
+	"name":    "name",
+	"phone":   "phone",
+	"created": "created",
+}
+
+//ListFilter narrows and orders a customer listing; Sort defaults to id,
+//Cursor is the next_cursor of the previous page. Phones lets Query match phones
+//and the listing be sorted by phone, which puts phones into cursors, so only
+//staff listings set it
+type ListFilter struct {
+	Active *bool
+	From   *time.Time
+	To     *time.Time
+	Query  string
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor string
+	Phones bool
+}
+
+//Page ...
+type Page struct {
+	Items      []*Customer `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Total      int64       `json:"total"`
+	Limit      int         `json:"limit"`
+}
+
+// cursor is the position after the last item of a page, the sort value and the id as a tie breaker
+type cursor struct {
+	Sort  string          `json:"s"`
+	Value json.RawMessage `json:"v"`
+	ID    int64           `json:"id"`
+}
+
+func (f *ListFilter) where() (string, []interface{}) {
+	conditions := []string{"deleted IS NULL"}
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.ReplaceAll(condition, "?", "$"+strconv.Itoa(len(args))))
+	}
+
+	if f.Active != nil {
+		add("active = ?", *f.Active)
+	}
+	if f.From != nil {
+		add("created >= ?", *f.From)
+	}
+	if f.To != nil {
+		add("created < ?", *f.To)
+	}
+	if f.Query != "" && f.Phones {
+		add(`(name ILIKE ? OR phone ILIKE ?)`, "%"+escapeLike(f.Query)+"%")
+	} else if f.Query != "" {
+		add(`name ILIKE ?`, "%"+escapeLike(f.Query)+"%")
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+//List returns a page of customers matching filter, pages are cut by keyset so they
+//stay stable while customers are added
+func (s *Service) List(ctx context.Context, filter *ListFilter) (*Page, error) {
+	if filter.Sort == "" {
+		filter.Sort = "id"
+	}
+	column, ok := sortColumns[filter.Sort]
+	if !ok || (filter.Sort == "phone" && !filter.Phones) {
+		return nil, ErrInvalidSort
+	}
+	if filter.Limit <= 0 {
+		filter.Limit = DefaultLimit
+	}
+	if filter.Limit > MaxLimit {
+		filter.Limit = MaxLimit
+	}
+	where, args := filter.where()
+
+	page := &Page{Items: make([]*Customer, 0), Limit: filter.Limit}
+	err := s.pool.QueryRow(ctx, `SELECT count(*) FROM customers`+where, args...).Scan(&page.Total)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+
+	direction, compare := "ASC", ">"
+	if filter.Desc {
+		direction, compare = "DESC", "<"
+	}
+	if filter.Cursor != "" {
+		value, id, err := decodeCursor(filter.Cursor, filter.Sort)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value, id)
+		keyset := "(" + column + ", id) " + compare + " ($" + strconv.Itoa(len(args)-1) + ", $" + strconv.Itoa(len(args)) + ")"
+		where += " AND " + keyset
+	}
+
+	// one extra row tells whether there is a next page
+	args = append(args, filter.Limit+1)
+	sqlSelect := `SELECT ` + customerColumns + ` FROM customers` + where + `
+	ORDER BY ` + column + ` ` + direction + `, id ` + direction + ` LIMIT $` + strconv.Itoa(len(args))
+	rows, err := s.pool.Query(ctx, sqlSelect, args...)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanCustomer(rows)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+		page.Items = append(page.Items, item)
+	}
+	err = rows.Err()
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+
+	if len(page.Items) > filter.Limit {
+		page.Items = page.Items[:filter.Limit]
+		page.NextCursor, err = encodeCursor(filter.Sort, page.Items[filter.Limit-1])
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+	}
+	return page, nil
+}
+
+func encodeCursor(sort string, item *Customer) (string, error) {
+	var value interface{}
+	switch sort {
+	case "name":
+		value = item.Name
+	case "phone":
+		value = item.Phone
+	case "created":
+		value = item.Created
+	default:
+		value = item.ID
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&cursor{Sort: sort, Value: raw, ID: item.ID})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor returns the typed sort value and the id of a cursor made for sort
+func decodeCursor(value string, sort string) (interface{}, int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	c := &cursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil || c.Sort != sort {
+		return nil, 0, ErrInvalidCursor
+	}
+
+	var typed interface{}
+	switch sort {
+	case "name", "phone":
+		var text string
+		err = json.Unmarshal(c.Value, &text)
+		typed = text
+	case "created":
+		var created time.Time
+		err = json.Unmarshal(c.Value, &created)
+		typed = created
+	default:
+		var id int64
+		err = json.Unmarshal(c.Value, &id)
+		typed = id
+	}
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	return typed, c.ID, nil
+}
@@ -0,0 +1,69 @@
+package customers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/SsSJKK/crud/pkg/phone"
+	"github.com/jackc/pgx/v4"
+)
+
+//ErrVersionMismatch ...
+var ErrVersionMismatch = errors.New("customer was changed by someone else")
+
+//Patch holds the fields a merge patch sets, nil fields keep their value
+type Patch struct {
+	Name   *string
+	Phone  *string
+	Active *bool
+}
+
+//Update applies patch if the customer still has one of versions, nil versions
+//apply it to whatever version there is; every change bumps the version and a
+//new phone is stored in E.164
+func (s *Service) Update(ctx context.Context, id int64, versions []int64, patch *Patch) (*Customer, error) {
+	if patch.Phone != nil {
+		number, err := phone.Normalize(*patch.Phone)
+		if err != nil {
+			return nil, err
+		}
+		patch.Phone = &number
+	}
+
+	sqlStatement := `update customers
+	set name=coalesce($3, name), phone=coalesce($4, phone), active=coalesce($5, active), version=version+1
+	where id=$1 and deleted is null and ($2::bigint[] is null or version = any($2))
+	and not exists (select from customers other where other.phone = $4 and other.id <> $1 and other.deleted is null)
+	returning ` + customerColumns
+	item, err := scanCustomer(s.pool.QueryRow(ctx, sqlStatement, id, versions, patch.Name, patch.Phone, patch.Active))
+	if err == nil {
+		return item, nil
+	}
+	if isPhoneInUse(err) {
+		return nil, ErrPhoneInUse
+	}
+	if err != pgx.ErrNoRows {
+		logging.FromContext(ctx).Print(err)
+		return nil, ErrInternal
+	}
+
+	// find out which condition failed
+	current, err := s.ByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if versions != nil && !containsVersion(versions, current.Version) {
+		return nil, ErrVersionMismatch
+	}
+	return nil, ErrPhoneInUse
+}
+
+func containsVersion(versions []int64, version int64) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package customers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+//ErrPhoneInUse ...
+var ErrPhoneInUse = errors.New("phone belongs to another customer")
+
+// uniqueViolation is the SQLSTATE postgres answers when customers_phone_idx is broken
+const uniqueViolation = "23505"
+
+// isPhoneInUse tells whether err comes from a concurrent write that took the phone first
+func isPhoneInUse(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+//Restore undoes Delete as long as the customer has not been purged
+//and nobody has registered with the phone in the meantime
+func (s *Service) Restore(ctx context.Context, id int64) (*Customer, error) {
+	sqlStatement := `update customers set deleted=null, deleted_by=null, version=version+1
+	where id=$1 and deleted is not null and anonymized is null
+	and not exists (select from customers other where other.phone = customers.phone and other.deleted is null)
+	returning ` + customerColumns
+	item, err := scanCustomer(s.pool.QueryRow(ctx, sqlStatement, id))
+	if err == nil {
+		return item, nil
+	}
+	if isPhoneInUse(err) {
+		return nil, ErrPhoneInUse
+	}
+	if err != pgx.ErrNoRows {
+		logging.FromContext(ctx).Print(err)
+		return nil, ErrInternal
+	}
+
+	var restorable bool
+	err = s.pool.QueryRow(ctx, `select exists (select from customers where id=$1 and deleted is not null and anonymized is null)`,
+		id).Scan(&restorable)
+	if err != nil {
+		logging.FromContext(ctx).Print(err)
+		return nil, ErrInternal
+	}
+	if restorable {
+		return nil, ErrPhoneInUse
+	}
+	return nil, ErrNotFound
+}
+
+//Purge anonymizes customers deleted more than retention ago: name, phone and password
+//are wiped and their sessions dropped, the row stays so that sales keep their customer
+func (s *Service) Purge(ctx context.Context, retention time.Duration) (n int64, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return 0, ErrInternal
+	}
+	defer func() {
+		if err != nil {
+			if errR := tx.Rollback(ctx); errR != nil {
+				logging.FromContext(ctx).Println(errR)
+			}
+			return
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			err = ErrInternal
+		}
+	}()
+
+	tag, err := tx.Exec(ctx, `update customers
+	set name='', phone='deleted:' || id, password='', active=false, anonymized=CURRENT_TIMESTAMP
+	where deleted < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second' and anonymized is null`,
+		int64(retention/time.Second))
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return 0, ErrInternal
+	}
+
+	_, err = tx.Exec(ctx, `delete from customers_tokens t using customers c
+	where c.id = t.customer_id and c.anonymized is not null`)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return 0, ErrInternal
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,27 @@
+package customers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestIsPhoneInUse(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pgconn.PgError{Code: uniqueViolation, ConstraintName: "customers_phone_idx"}, true},
+		{fmt.Errorf("insert: %w", &pgconn.PgError{Code: uniqueViolation}), true},
+		{&pgconn.PgError{Code: "23503"}, false},
+		{pgx.ErrNoRows, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isPhoneInUse(tt.err); got != tt.want {
+			t.Errorf("isPhoneInUse(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
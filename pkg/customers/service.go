@@ -2,11 +2,13 @@ package customers
 
 import (
 	"context"
-	"database/sql"
 	"errors"
-	"log"
+	"sort"
 	"time"
 
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/SsSJKK/crud/pkg/phone"
+	"github.com/SsSJKK/crud/pkg/stock"
 	"github.com/jackc/pgx/v4"
 
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -33,9 +35,10 @@ type Customer struct {
 	ID       int64     `json:"id"`
 	Name     string    `json:"name"`
 	Phone    string    `json:"phone"`
-	Password string    `json:"password"`
+	Password string    `json:"-"`
 	Active   bool      `json:"active"`
 	Created  time.Time `json:"created"`
+	Version  int64     `json:"version"`
 }
 
 //Product ...
@@ -46,84 +49,54 @@ type Product struct {
 	Qty   int    `json:"qty"`
 }
 
-//All ....
-func (s *Service) All(ctx context.Context) (cs []*Customer, err error) {
-
-	sqlStatement := `select * from customers`
-
-	rows, err := s.pool.Query(ctx, sqlStatement)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		item := &Customer{}
-		err := rows.Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Password,
-			&item.Active,
-			&item.Created,
-		)
-		if err != nil {
-			log.Println(err)
-		}
-		cs = append(cs, item)
-	}
-
-	return cs, nil
+//Purchase ...
+type Purchase struct {
+	ID        int64               `json:"id"`
+	ManagerID *int64              `json:"manager_id"`
+	Created   time.Time           `json:"created"`
+	Positions []*PurchasePosition `json:"positions"`
 }
 
-//AllActive ....
-func (s *Service) AllActive(ctx context.Context) (cs []*Customer, err error) {
-
-	sqlStatement := `select * from customers where active=true`
-
-	rows, err := s.pool.Query(ctx, sqlStatement)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		item := &Customer{}
-		err := rows.Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Password,
-			&item.Active,
-			&item.Created,
-		)
-		if err != nil {
-			log.Println(err)
-		}
-		cs = append(cs, item)
-	}
+//PurchasePosition ...
+type PurchasePosition struct {
+	ProductID int64  `json:"product_id"`
+	Name      string `json:"name"`
+	Price     int64  `json:"price"`
+	Qty       int64  `json:"qty"`
+}
 
-	return cs, nil
+//OrderItem ...
+type OrderItem struct {
+	ProductID int64 `json:"product_id"`
+	Qty       int64 `json:"qty"`
 }
 
-//ByID ...
-func (s *Service) ByID(ctx context.Context, id int64) (*Customer, error) {
-	item := &Customer{}
+// customerColumns are scanned by scanCustomer, in this order
+const customerColumns = `id, name, phone, password, active, created, version`
 
-	sqlStatement := `select * from customers where id=$1`
-	err := s.pool.QueryRow(ctx, sqlStatement, id).Scan(
+func scanCustomer(row pgx.Row) (*Customer, error) {
+	item := &Customer{}
+	err := row.Scan(
 		&item.ID,
 		&item.Name,
 		&item.Phone,
 		&item.Password,
 		&item.Active,
-		&item.Created)
+		&item.Created,
+		&item.Version)
+	return item, err
+}
+
+//ByID ...
+func (s *Service) ByID(ctx context.Context, id int64) (*Customer, error) {
+	sqlStatement := `select ` + customerColumns + ` from customers where id=$1 and deleted is null`
+	item, err := scanCustomer(s.pool.QueryRow(ctx, sqlStatement, id))
 
 	if err == pgx.ErrNoRows {
 		return nil, ErrNotFound
 	}
 	if err != nil {
-		log.Print(err)
+		logging.FromContext(ctx).Print(err)
 		return nil, ErrInternal
 	}
 	return item, nil
@@ -132,116 +105,55 @@ func (s *Service) ByID(ctx context.Context, id int64) (*Customer, error) {
 
 //ChangeActive ...
 func (s *Service) ChangeActive(ctx context.Context, id int64, active bool) (*Customer, error) {
-	item := &Customer{}
+	sqlStatement := `update customers set active=$2, version=version+1 where id=$1 and deleted is null returning ` + customerColumns
+	item, err := scanCustomer(s.pool.QueryRow(ctx, sqlStatement, id, active))
 
-	sqlStatement := `update customers set active=$2 where id=$1 returning *`
-	err := s.pool.QueryRow(ctx, sqlStatement, id, active).Scan(
-		&item.ID,
-		&item.Name,
-		&item.Phone,
-		&item.Password,
-		&item.Active,
-		&item.Created)
-
-	if err == sql.ErrNoRows {
+	if err == pgx.ErrNoRows {
 		return nil, ErrNotFound
 	}
 	if err != nil {
-		log.Print(err)
+		logging.FromContext(ctx).Print(err)
 		return nil, ErrInternal
 	}
 	return item, nil
 
 }
 
-//Delete ...
-func (s *Service) Delete(ctx context.Context, id int64) (*Customer, error) {
-	item := &Customer{}
-
-	sqlStatement := `delete from customers  where id=$1 returning *`
-	err := s.pool.QueryRow(ctx, sqlStatement, id).Scan(
-		&item.ID,
-		&item.Name,
-		&item.Phone,
-		&item.Password,
-		&item.Active,
-		&item.Created)
+//Delete marks a customer as deleted by the manager actorID, the row and its sales stay
+//until the purge anonymizes it
+func (s *Service) Delete(ctx context.Context, id int64, actorID int64) (*Customer, error) {
+	sqlStatement := `update customers set deleted=CURRENT_TIMESTAMP, deleted_by=$2
+	where id=$1 and deleted is null returning ` + customerColumns
+	item, err := scanCustomer(s.pool.QueryRow(ctx, sqlStatement, id, actorID))
 
-	if err == sql.ErrNoRows {
+	if err == pgx.ErrNoRows {
 		return nil, ErrNotFound
 	}
 	if err != nil {
-		log.Print(err)
+		logging.FromContext(ctx).Print(err)
 		return nil, ErrInternal
 	}
 	return item, nil
 
 }
 
-//Save ...
-func (s *Service) Save(ctx context.Context, customer *Customer) (c *Customer, err error) {
-
-	item := &Customer{}
-
-	if customer.ID == 0 {
-		sqlStatement := `insert into customers(name, phone) values($1, $2) returning *`
-		err = s.pool.QueryRow(ctx, sqlStatement, customer.Name, customer.Phone).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Password,
-			&item.Active,
-			&item.Created)
-	} else {
-		sqlStatement := `update customers set name=$1, phone=$2 where id=$3 returning *`
-		err = s.pool.QueryRow(ctx, sqlStatement, customer.Name, customer.Phone, customer.ID).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Password,
-			&item.Active,
-			&item.Created)
-	}
-
+//APISave registers a new customer with the phone in E.164, existing ones are changed through Update
+func (s *Service) APISave(ctx context.Context, customer *Customer) (*Customer, error) {
+	number, err := phone.Normalize(customer.Phone)
 	if err != nil {
-		log.Print(err)
-		return nil, ErrInternal
+		return nil, err
 	}
-	return item, nil
 
-}
-
-//APISave ...
-func (s *Service) APISave(ctx context.Context, customer *Customer) (c *Customer, err error) {
-
-	item := &Customer{}
-
-	if customer.ID == 0 {
-		sqlStatement := `insert into customers(name, phone, password) values($1, $2, $3) returning *`
-		err = s.pool.QueryRow(ctx, sqlStatement, customer.Name, customer.Phone, customer.Password).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Password,
-			&item.Active,
-			&item.Created)
-	} else {
-		sqlStatement := `update customers set name=$1, phone=$2, password=$4 where id=$3 returning *`
-		err = s.pool.QueryRow(ctx, sqlStatement, customer.Name, customer.Phone, customer.ID, customer.Password).Scan(
-			&item.ID,
-			&item.Name,
-			&item.Phone,
-			&item.Password,
-			&item.Active,
-			&item.Created)
+	sqlStatement := `insert into customers(name, phone, password) values($1, $2, $3) returning ` + customerColumns
+	item, err := scanCustomer(s.pool.QueryRow(ctx, sqlStatement, customer.Name, number, customer.Password))
+	if isPhoneInUse(err) {
+		return nil, ErrPhoneInUse
 	}
-
 	if err != nil {
-		log.Print(err)
+		logging.FromContext(ctx).Print(err)
 		return nil, ErrInternal
 	}
 	return item, nil
-
 }
 
 //Products ...
@@ -262,7 +174,7 @@ func (s *Service) Products(ctx context.Context) ([]*Product, error) {
 		item := &Product{}
 		err = rows.Scan(&item.ID, &item.Name, &item.Price, &item.Qty)
 		if err != nil {
-			log.Println(err)
+			logging.FromContext(ctx).Println(err)
 			return nil, err
 		}
 		items = append(items, item)
@@ -270,27 +182,136 @@ func (s *Service) Products(ctx context.Context) ([]*Product, error) {
 
 	err = rows.Err()
 	if err != nil {
-		log.Println(err)
+		logging.FromContext(ctx).Println(err)
 		return nil, err
 	}
 
 	return items, nil
 }
 
-//IDByToken ...
-func (s *Service) IDByToken(ctx context.Context, token string) (int64, error) {
-	var id int64
-	err := s.pool.QueryRow(ctx,
-		`select id from managers where token = $1`, token).Scan(&id)
+//Purchases ...
+func (s *Service) Purchases(ctx context.Context, customerID int64) ([]*Purchase, error) {
+	items := make([]*Purchase, 0)
+	rows, err := s.pool.Query(ctx, `select s.id, s.manager_id, s.crated, sp.product_id, p.name, sp.price, sp.qty
+	from sales s
+	join sale_positions sp on sp.sale_id = s.id
+	join products p on p.id = sp.product_id
+	where s.customer_id = $1
+	order by s.id desc, sp.id`, customerID)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
 
-	if err == pgx.ErrNoRows {
-		return 0, nil
+	var last *Purchase
+	for rows.Next() {
+		sale := &Purchase{}
+		position := &PurchasePosition{}
+		err = rows.Scan(
+			&sale.ID,
+			&sale.ManagerID,
+			&sale.Created,
+			&position.ProductID,
+			&position.Name,
+			&position.Price,
+			&position.Qty,
+		)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+		if last == nil || last.ID != sale.ID {
+			last = sale
+			items = append(items, last)
+		}
+		last.Positions = append(last.Positions, position)
 	}
 
+	err = rows.Err()
 	if err != nil {
-		return 0, ErrInternal
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
 	}
 
-	return id, nil
+	return items, nil
 }
 
+//MakePurchase ...
+func (s *Service) MakePurchase(ctx context.Context, customerID int64, items []*OrderItem) (purchase *Purchase, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err != nil {
+			if errR := tx.Rollback(ctx); errR != nil {
+				logging.FromContext(ctx).Println(errR)
+			}
+			return
+		}
+		err = tx.Commit(ctx)
+	}()
+
+	purchase = &Purchase{}
+	err = tx.QueryRow(ctx, `INSERT INTO sales (customer_id) VALUES ($1) RETURNING id, manager_id, crated`,
+		customerID).Scan(&purchase.ID, &purchase.ManagerID, &purchase.Created)
+	if err != nil {
+		return nil, err
+	}
+
+	// same lock order as managers.Service.MakeSele
+	sorted := make([]*OrderItem, len(items))
+	copy(sorted, items)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ProductID < sorted[j].ProductID
+	})
+
+	sqlUpdate := `UPDATE products
+	SET
+	qty = qty - $1
+	WHERE id = $2 AND active AND qty >= $1
+	RETURNING name, price`
+	positions := make(map[int64]*PurchasePosition)
+	var insufficient []int64
+	for _, v := range sorted {
+		position := &PurchasePosition{ProductID: v.ProductID, Qty: v.Qty}
+		err = tx.QueryRow(ctx, sqlUpdate, v.Qty, v.ProductID).Scan(&position.Name, &position.Price)
+		if errors.Is(err, pgx.ErrNoRows) {
+			insufficient = append(insufficient, v.ProductID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		positions[v.ProductID] = position
+	}
+	if len(insufficient) != 0 {
+		return nil, &stock.ErrInsufficientStock{ProductIDs: insufficient}
+	}
+
+	sqlSalePositions := `INSERT INTO sale_positions (sale_id, product_id, price, list_price, qty)
+	VALUES (
+		$1,
+		$2,
+		$3,
+		$3,
+		$4
+	  );`
+	for _, v := range items {
+		position := positions[v.ProductID]
+		_, err = tx.Exec(ctx, sqlSalePositions, purchase.ID, v.ProductID, position.Price, v.Qty)
+		if err != nil {
+			return nil, err
+		}
+		purchase.Positions = append(purchase.Positions, &PurchasePosition{
+			ProductID: v.ProductID,
+			Name:      position.Name,
+			Price:     position.Price,
+			Qty:       v.Qty,
+		})
+	}
+
+	return purchase, nil
+}
@@ -0,0 +1,38 @@
+package logging
+
+import (
+	"context"
+	"log"
+	"os"
+)
+
+var std = log.New(os.Stderr, "", log.LstdFlags)
+
+type contextKey struct {
+	name string
+}
+
+var requestIDContextKey = &contextKey{"request id context"}
+
+var loggerContextKey = &contextKey{"logger context"}
+
+//WithRequestID stores the request ID and a logger that prefixes every line with it
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDContextKey, id)
+	logger := log.New(std.Writer(), "request_id="+id+" ", std.Flags()|log.Lmsgprefix)
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+//RequestID ...
+func RequestID(ctx context.Context) string {
+	value, _ := ctx.Value(requestIDContextKey).(string)
+	return value
+}
+
+//FromContext returns the request-scoped logger, or a plain one outside of requests
+func FromContext(ctx context.Context) *log.Logger {
+	if value, ok := ctx.Value(loggerContextKey).(*log.Logger); ok {
+		return value
+	}
+	return std
+}
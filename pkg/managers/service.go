@@ -3,21 +3,46 @@ package managers
 import (
 	"context"
 	"errors"
-	"log"
+	"sort"
 	"time"
 
 	"github.com/SsSJKK/crud/cmd/app/middleware"
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/SsSJKK/crud/pkg/phone"
+	"github.com/SsSJKK/crud/pkg/security"
+	"github.com/SsSJKK/crud/pkg/stock"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 //ErrInternal ...
 var ErrInternal = errors.New("internal error")
 
+//ErrNotFound ...
+var ErrNotFound = errors.New("manager not found")
+
 // ErrExpireToken ...
 var ErrExpireToken = errors.New("ExpireToken error")
 
+//ErrPriceOverride ...
+var ErrPriceOverride = errors.New("price override not allowed")
+
+//ErrNoOverrideReason ...
+var ErrNoOverrideReason = errors.New("price override reason required")
+
+//ErrInvalidToken ...
+var ErrInvalidToken = errors.New("invalid token")
+
+const (
+	//RoleAdmin ...
+	RoleAdmin = "ADMIN"
+	//RoleManager ...
+	RoleManager = "MANAGER"
+	//RoleDiscount ...
+	RoleDiscount = "DISCOUNT"
+)
+
 //Service ...
 type Service struct {
 	pool *pgxpool.Pool
@@ -33,7 +58,7 @@ type Managers struct {
 	ID       int64     `json:"id"`
 	Name     string    `json:"name"`
 	Phone    string    `json:"phone"`
-	Password string    `json:"password"`
+	Password string    `json:"-"`
 	Roles    []string  `json:"roles"`
 	Active   bool      `json:"active"`
 	Created  time.Time `json:"created"`
@@ -65,40 +90,34 @@ type Product struct {
 //	Created   time.Time `json:"created"`
 //}
 
+//Position ...
+type Position struct {
+	ID        int64  `json:"id"`
+	ProductID int64  `json:"product_id"`
+	Qty       int64  `json:"qty"`
+	Price     int64  `json:"price"`
+	Reason    string `json:"reason,omitempty"`
+}
+
 //SalePositions ...
 type SalePositions struct {
-	ID         int64 `json:"id"`
-	CustomerID int64 `json:"customer_id"`
-	Positions  []struct {
-		ID        int64 `json:"id"`
-		ProductID int64 `json:"product_id"`
-		Qty       int64 `json:"qty"`
-		Price     int64 `json:"price"`
-	} `json:"positions"`
+	ID         int64       `json:"id"`
+	CustomerID int64       `json:"customer_id"`
+	Positions  []*Position `json:"positions"`
 }
 
-//Registration ...
+//Registration inserts a manager with the phone in E.164, item.Password must already be hashed
 func (s *Service) Registration(ctx context.Context, item *Managers) (*Managers, error) {
-	sql := `INSERT INTO managers (	name,	phone,	password,	roles  ) VALUES ($1, $2,$3,	$4) returning *`
-
-	manager := &Managers{}
-	var id int64
-	idM, err := middleware.Authentication(ctx)
+	number, err := phone.Normalize(item.Phone)
 	if err != nil {
 		return nil, err
 	}
-	err = s.pool.QueryRow(ctx, `select id from managers WHERE roles[2] = 'ADMIN' and id = $1`, idM).Scan(&id)
-	if err == pgx.ErrNoRows {
-		log.Println("No priv", err)
-		return nil, err
-	}
 
-	if err != nil {
-		log.Println("No priv", err)
-		return nil, err
-	}
+	sql := `INSERT INTO managers (	name,	phone,	password,	roles  ) VALUES ($1, $2,$3,	$4)
+	returning id, name, phone, password, roles, active, creatred`
 
-	err = s.pool.QueryRow(ctx, sql, item.Name, item.Phone, item.Password, item.Roles).Scan(
+	manager := &Managers{}
+	err = s.pool.QueryRow(ctx, sql, item.Name, number, item.Password, item.Roles).Scan(
 		&manager.ID,
 		&manager.Name,
 		&manager.Phone,
@@ -109,7 +128,7 @@ func (s *Service) Registration(ctx context.Context, item *Managers) (*Managers,
 	)
 
 	if err != nil {
-		log.Println(err)
+		logging.FromContext(ctx).Println(err)
 		return nil, err
 	}
 
@@ -117,15 +136,42 @@ func (s *Service) Registration(ctx context.Context, item *Managers) (*Managers,
 
 }
 
+//ByID returns a manager without the password hash
+func (s *Service) ByID(ctx context.Context, id int64) (*Managers, error) {
+	manager := &Managers{}
+	err := s.pool.QueryRow(ctx, `SELECT id, name, phone, roles, active, creatred FROM managers WHERE id = $1`, id).Scan(
+		&manager.ID,
+		&manager.Name,
+		&manager.Phone,
+		&manager.Roles,
+		&manager.Active,
+		&manager.Created,
+	)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	return manager, nil
+}
+
 //IDByToken ...
 func (s *Service) IDByToken(ctx context.Context, token string) (int64, error) {
 	var id int64
 	var expire time.Time
 	err := s.pool.QueryRow(ctx,
-		`select manager_id, expire from managers_tokens where token = $1`, token).Scan(&id, &expire)
+		`update managers_tokens set last_used = CURRENT_TIMESTAMP
+		where token = $1 and revoked is null and manager_id in (select id from managers where active)
+		returning manager_id, expire`, security.HashToken(token)).Scan(&id, &expire)
 
-	if err == pgx.ErrNoRows {
-		return 0, nil
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, ErrInvalidToken
+	}
+
+	if err != nil {
+		return 0, ErrInternal
 	}
 
 	timeNow := time.Now().Format("2006-01-02 15:04:05")
@@ -135,11 +181,67 @@ func (s *Service) IDByToken(ctx context.Context, token string) (int64, error) {
 		return 0, ErrExpireToken
 	}
 
+	return id, nil
+}
+
+//Roles ...
+func (s *Service) Roles(ctx context.Context, id int64) ([]string, error) {
+	var roles []string
+	err := s.pool.QueryRow(ctx, `select roles from managers where id = $1 and active`, id).Scan(&roles)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
 	if err != nil {
-		return 0, ErrInternal
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
 	}
+	return roles, nil
+}
 
-	return id, nil
+//HasAnyRole reports whether the authenticated manager has any of roles. Roles carried
+//in token claims are trusted as they are, which lets a demoted or deactivated manager keep
+//them until the access token expires (AccessTokenTTL) - RevokeManagerTokens can't cut that
+//short across restarts, its denylist lives in memory. ADMIN is the exception: when a grant
+//rests on it alone it is confirmed against the database
+func (s *Service) HasAnyRole(ctx context.Context, roles ...string) bool {
+	id, err := middleware.Authentication(ctx)
+	if err != nil {
+		return false
+	}
+	managerRoles, fromClaims := middleware.Roles(ctx)
+	if !fromClaims {
+		managerRoles, err = s.Roles(ctx, id)
+		if err != nil {
+			return false
+		}
+	}
+
+	admin := false
+	for _, role := range managerRoles {
+		for _, r := range roles {
+			if role != r {
+				continue
+			}
+			if role != RoleAdmin || !fromClaims {
+				return true
+			}
+			admin = true
+		}
+	}
+	if !admin {
+		return false
+	}
+
+	current, err := s.Roles(ctx, id)
+	if err != nil {
+		return false
+	}
+	for _, role := range current {
+		if role == RoleAdmin {
+			return true
+		}
+	}
+	return false
 }
 
 //ChangeProduct ...
@@ -182,50 +284,127 @@ func (s *Service) ChangeProduct(ctx context.Context, item *Product) (*Product, e
 	return product, nil
 }
 
-//MakeSele ...
-func (s *Service) MakeSele(ctx context.Context, saleP *SalePositions, idManager int64) error {
-	var idSale int64
+//MakeSele records a sale by the manager idManager and returns its id
+func (s *Service) MakeSele(ctx context.Context, saleP *SalePositions, idManager int64) (idSale int64, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return 0, ErrInternal
+	}
+	defer func() {
+		if err != nil {
+			if errR := tx.Rollback(ctx); errR != nil {
+				logging.FromContext(ctx).Println(errR)
+			}
+			return
+		}
+		err = tx.Commit(ctx)
+	}()
+
 	sqlSales := `INSERT INTO sales (manager_id, customer_id)
 	VALUES (
 		$1,
 		$2
 	  ) RETURNING id;`
-	err := s.pool.QueryRow(ctx, sqlSales, idManager, saleP.CustomerID).Scan(&idSale)
-
+	err = tx.QueryRow(ctx, sqlSales, idManager, saleP.CustomerID).Scan(&idSale)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	sqlSalePositions := `INSERT INTO sale_positions (sale_id, product_id, price, qty)
+
+	// decrement stock in product_id order so that concurrent sales
+	// lock product rows in the same order
+	positions := make([]*Position, len(saleP.Positions))
+	copy(positions, saleP.Positions)
+	sort.SliceStable(positions, func(i, j int) bool {
+		return positions[i].ProductID < positions[j].ProductID
+	})
+
+	sqlUpdate := `UPDATE products
+	SET
+	qty = qty - $1
+	WHERE id = $2 AND qty >= $1
+	RETURNING price`
+	prices := make(map[int64]int64)
+	var insufficient, unknown []int64
+	for _, v := range positions {
+		var price int64
+		err = tx.QueryRow(ctx, sqlUpdate, v.Qty, v.ProductID).Scan(&price)
+		if errors.Is(err, pgx.ErrNoRows) {
+			var exists bool
+			err = tx.QueryRow(ctx, `SELECT EXISTS (SELECT FROM products WHERE id = $1)`, v.ProductID).Scan(&exists)
+			if err != nil {
+				return 0, err
+			}
+			if !exists {
+				unknown = append(unknown, v.ProductID)
+				continue
+			}
+			insufficient = append(insufficient, v.ProductID)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		prices[v.ProductID] = price
+	}
+	if len(unknown) != 0 {
+		return 0, &stock.ErrUnknownProducts{ProductIDs: unknown}
+	}
+	if len(insufficient) != 0 {
+		return 0, &stock.ErrInsufficientStock{ProductIDs: insufficient}
+	}
+
+	canDiscount := false
+	checked := false
+	sqlSalePositions := `INSERT INTO sale_positions (sale_id, product_id, price, list_price, price_reason, qty)
 	VALUES (
 		$1,
 		$2,
 		$3,
-		$4
+		$4,
+		$5,
+		$6
 	  );`
-	sqlUpdate := `UPDATE products
-	SET
-	qty = $1
-	WHERE id=$2`
 	for _, v := range saleP.Positions {
-		var qty int64
-		err = s.pool.QueryRow(ctx, `select qty from products where id = $1`, v.ProductID).Scan(&qty)
-		if err != nil {
-			return err
-		}
-		_, err = s.pool.Exec(ctx, sqlUpdate, qty-v.Qty, v.ProductID)
-		if err != nil {
-			return err
+		listPrice := prices[v.ProductID]
+		price := listPrice
+		var reason *string
+		if v.Price != 0 && v.Price != listPrice {
+			if !checked {
+				canDiscount, err = s.hasRole(ctx, tx, idManager, RoleDiscount)
+				if err != nil {
+					return 0, err
+				}
+				checked = true
+			}
+			if !canDiscount {
+				return 0, ErrPriceOverride
+			}
+			if v.Reason == "" {
+				return 0, ErrNoOverrideReason
+			}
+			price = v.Price
+			reason = &v.Reason
 		}
-		_, err = s.pool.Exec(ctx, sqlSalePositions, idSale, v.ProductID, v.Price, v.Qty)
+		_, err = tx.Exec(ctx, sqlSalePositions, idSale, v.ProductID, price, listPrice, reason, v.Qty)
 		if err != nil {
-			return err
+			return 0, err
 		}
 	}
+
+	return idSale, nil
+}
+
+func (s *Service) hasRole(ctx context.Context, tx pgx.Tx, id int64, role string) (bool, error) {
+	var ok bool
+	err := tx.QueryRow(ctx, `select $2 = any(roles) from managers where id = $1`, id, role).Scan(&ok)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
-
-	return nil
+	return ok, nil
 }
 
 //GetSales ...
@@ -238,7 +417,6 @@ func (s *Service) GetSales(ctx context.Context, id int64) (int64, error) {
 	JOIN sale_positions as sp on sp.sale_id = s.id
 	where s.manager_id = $1
 	GROUP by s.manager_id;`
-	log.Println(id)
 	s.pool.QueryRow(ctx, sql, id).Scan(&getSales.id, &getSales.sum)
 
 	return getSales.sum, nil
@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Notifier delivers short messages (one-time codes) to a phone number
+type Notifier interface {
+	Notify(ctx context.Context, phone string, message string) error
+}
+
+//LogNotifier writes messages to w instead of sending them, for local testing
+type LogNotifier struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+//NewLogNotifier ...
+func NewLogNotifier(w io.Writer) *LogNotifier {
+	return &LogNotifier{w: w}
+}
+
+//Notify ...
+func (n *LogNotifier) Notify(ctx context.Context, phone string, message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, err := fmt.Fprintf(n.w, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), phone, message)
+	return err
+}
+
+//WebhookNotifier posts every message as JSON {"phone": ..., "message": ...} to a URL,
+//an SMS gateway or a relay in front of one
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+//NewWebhookNotifier ...
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+//Notify ...
+func (n *WebhookNotifier) Notify(ctx context.Context, phone string, message string) error {
+	body, err := json.Marshal(map[string]string{"phone": phone, "message": message})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("notify webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package phone
+
+import (
+	"errors"
+	"strings"
+)
+
+//ErrInvalid ...
+var ErrInvalid = errors.New("invalid phone number")
+
+//ErrUnknownRegion ...
+var ErrUnknownRegion = errors.New("unknown phone region")
+
+//DefaultRegion is the region numbers without a country code belong to unless configured otherwise
+const DefaultRegion = "TJ"
+
+// region describes how numbers are dialed inside a country
+type region struct {
+	code   string // country calling code
+	trunk  string // national prefix dropped in E.164, "" if there is none
+	length int    // digits of a national significant number
+}
+
+var regions = map[string]region{
+	"TJ": {code: "992", trunk: "8", length: 9},
+	"UZ": {code: "998", length: 9},
+	"KG": {code: "996", trunk: "0", length: 9},
+	"KZ": {code: "7", trunk: "8", length: 10},
+	"RU": {code: "7", trunk: "8", length: 10},
+	"US": {code: "1", trunk: "1", length: 10},
+}
+
+var defaultRegion = regions[DefaultRegion]
+
+//SetDefaultRegion picks the region of numbers written without a country code,
+//it is meant to be called once at startup
+func SetDefaultRegion(name string) error {
+	r, ok := regions[strings.ToUpper(name)]
+	if !ok {
+		return ErrUnknownRegion
+	}
+	defaultRegion = r
+	return nil
+}
+
+//Normalize returns number in E.164 (+ and up to 15 digits); spaces, dashes, dots
+//and parentheses are ignored, 00 works as +, and a number without a country code
+//is taken as a national one of the default region
+func Normalize(number string) (string, error) {
+	number = strings.TrimSpace(number)
+	international := false
+	switch {
+	case strings.HasPrefix(number, "+"):
+		international, number = true, number[1:]
+	case strings.HasPrefix(number, "00"):
+		international, number = true, number[2:]
+	}
+
+	digits := make([]byte, 0, len(number))
+	for i := 0; i < len(number); i++ {
+		c := number[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return "", ErrInvalid
+		}
+	}
+	national := string(digits)
+
+	if international {
+		if len(national) < 8 || len(national) > 15 || national[0] == '0' {
+			return "", ErrInvalid
+		}
+		return "+" + national, nil
+	}
+
+	r := defaultRegion
+	switch {
+	case len(national) == r.length:
+	case r.trunk != "" && len(national) == len(r.trunk)+r.length && strings.HasPrefix(national, r.trunk):
+		national = national[len(r.trunk):]
+	case len(national) == len(r.code)+r.length && strings.HasPrefix(national, r.code):
+		// the country code was written without the +
+		national = national[len(r.code):]
+	default:
+		return "", ErrInvalid
+	}
+	return "+" + r.code + national, nil
+}
+
+//Valid reports whether number can be normalized
+func Valid(number string) bool {
+	_, err := Normalize(number)
+	return err == nil
+}
@@ -0,0 +1,74 @@
+package phone
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		region string
+		number string
+		want   string
+		err    error
+	}{
+		// international forms don't depend on the region
+		{"TJ", "+992 92 777 66 55", "+992927776655", nil},
+		{"TJ", "00992927776655", "+992927776655", nil},
+		{"TJ", "00 992 (92) 777-66-55", "+992927776655", nil},
+		{"RU", "+992.92.777.66.55", "+992927776655", nil},
+		{"TJ", "+7 (916) 123-45-67", "+79161234567", nil},
+		{"TJ", "+0123456789", "", ErrInvalid},
+		{"TJ", "+1234567", "", ErrInvalid},
+		{"TJ", "+1234567890123456", "", ErrInvalid},
+
+		// national forms: bare number, trunk prefix, country code without +
+		{"TJ", "(92) 777-66-55", "+992927776655", nil},
+		{"TJ", "8 92 777 66 55", "+992927776655", nil},
+		{"TJ", "992927776655", "+992927776655", nil},
+		{"TJ", "0 92 777 66 55", "", ErrInvalid},
+		{"UZ", "90 123 45 67", "+998901234567", nil},
+		{"UZ", "8 90 123 45 67", "", ErrInvalid},
+		{"KG", "0 555 12 34 56", "+996555123456", nil},
+		{"KG", "996555123456", "+996555123456", nil},
+
+		// KZ and RU share the country code 7 and the trunk 8
+		{"KZ", "8 701 123 45 67", "+77011234567", nil},
+		{"KZ", "7 701 123 45 67", "+77011234567", nil},
+		{"RU", "8 916 123 45 67", "+79161234567", nil},
+		{"RU", "916 123 45 67", "+79161234567", nil},
+		{"RU", "79161234567", "+79161234567", nil},
+
+		// in the US the trunk prefix is the country code itself
+		{"US", "(212) 555-0100", "+12125550100", nil},
+		{"US", "1 212 555 0100", "+12125550100", nil},
+		{"US", "+1 212 555 0100", "+12125550100", nil},
+		{"US", "011 212 555 0100", "", ErrInvalid},
+
+		{"TJ", "", "", ErrInvalid},
+		{"TJ", "12345", "", ErrInvalid},
+		{"TJ", "92 777 66 55 ext 1", "", ErrInvalid},
+		{"TJ", "abc", "", ErrInvalid},
+	}
+	defer func() {
+		defaultRegion = regions[DefaultRegion]
+	}()
+	for _, tt := range tests {
+		if err := SetDefaultRegion(tt.region); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Normalize(tt.number)
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: Normalize(%q) = %q, %v; want %q, %v", tt.region, tt.number, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSetDefaultRegion(t *testing.T) {
+	defer func() {
+		defaultRegion = regions[DefaultRegion]
+	}()
+	if err := SetDefaultRegion("kz"); err != nil {
+		t.Errorf("SetDefaultRegion(kz) = %v", err)
+	}
+	if err := SetDefaultRegion("XX"); err != ErrUnknownRegion {
+		t.Errorf("SetDefaultRegion(XX) = %v; want %v", err, ErrUnknownRegion)
+	}
+}
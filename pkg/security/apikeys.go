@@ -0,0 +1,223 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/jackc/pgx/v4"
+)
+
+//APIKeyPrefix marks API keys in the Authorization header, session tokens are plain hex
+const APIKeyPrefix = "ak_"
+
+// API key scopes, one per manager resource and access level
+const (
+	ScopeProductsRead   = "products:read"
+	ScopeProductsWrite  = "products:write"
+	ScopeSalesRead      = "sales:read"
+	ScopeSalesWrite     = "sales:write"
+	ScopeCustomersRead  = "customers:read"
+	ScopeCustomersWrite = "customers:write"
+)
+
+var knownScopes = map[string]bool{
+	ScopeProductsRead:   true,
+	ScopeProductsWrite:  true,
+	ScopeSalesRead:      true,
+	ScopeSalesWrite:     true,
+	ScopeCustomersRead:  true,
+	ScopeCustomersWrite: true,
+}
+
+//ErrInvalidScope ...
+var ErrInvalidScope = errors.New("invalid scope")
+
+//ErrInvalidAllowlist ...
+var ErrInvalidAllowlist = errors.New("invalid ip allowlist entry")
+
+//ErrAddressNotAllowed ...
+var ErrAddressNotAllowed = errors.New("address not allowed for api key")
+
+//APIKey ...
+type APIKey struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	ManagerID int64      `json:"manager_id"`
+	Scopes    []string   `json:"scopes"`
+	Allowlist []string   `json:"ip_allowlist"`
+	Expire    *time.Time `json:"expire"`
+	LastUsed  *time.Time `json:"last_used"`
+	Revoked   *time.Time `json:"revoked"`
+	Created   time.Time  `json:"created"`
+}
+
+func validAllowlist(allowlist []string) bool {
+	for _, entry := range allowlist {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			continue
+		}
+		if net.ParseIP(entry) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func allowed(allowlist []string, ip string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, entry := range allowlist {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(addr) {
+				return true
+			}
+			continue
+		}
+		if other := net.ParseIP(entry); other != nil && other.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+//CreateAPIKey stores a new key and returns it, the key itself is never shown again
+func (s *Service) CreateAPIKey(ctx context.Context, managerID int64, item *APIKey) (*APIKey, string, error) {
+	if len(item.Scopes) == 0 {
+		return nil, "", ErrInvalidScope
+	}
+	for _, scope := range item.Scopes {
+		if !knownScopes[scope] {
+			return nil, "", ErrInvalidScope
+		}
+	}
+	if !validAllowlist(item.Allowlist) {
+		return nil, "", ErrInvalidAllowlist
+	}
+	if item.Allowlist == nil {
+		item.Allowlist = []string{}
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	key := APIKeyPrefix + secret
+
+	apiKey := &APIKey{}
+	err = s.pool.QueryRow(ctx, `INSERT INTO api_keys (name, key, manager_id, scopes, ip_allowlist, expire)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, name, manager_id, scopes, ip_allowlist, expire, last_used, revoked, created`,
+		item.Name, HashToken(key), managerID, item.Scopes, item.Allowlist, item.Expire,
+	).Scan(
+		&apiKey.ID,
+		&apiKey.Name,
+		&apiKey.ManagerID,
+		&apiKey.Scopes,
+		&apiKey.Allowlist,
+		&apiKey.Expire,
+		&apiKey.LastUsed,
+		&apiKey.Revoked,
+		&apiKey.Created,
+	)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, "", ErrInternal
+	}
+	return apiKey, key, nil
+}
+
+//APIKeys ...
+func (s *Service) APIKeys(ctx context.Context) ([]*APIKey, error) {
+	items := make([]*APIKey, 0)
+	rows, err := s.pool.Query(ctx, `SELECT id, name, manager_id, scopes, ip_allowlist, expire, last_used, revoked, created
+	FROM api_keys ORDER BY id DESC`)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := &APIKey{}
+		err = rows.Scan(
+			&item.ID,
+			&item.Name,
+			&item.ManagerID,
+			&item.Scopes,
+			&item.Allowlist,
+			&item.Expire,
+			&item.LastUsed,
+			&item.Revoked,
+			&item.Created,
+		)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+
+	return items, nil
+}
+
+//RevokeAPIKey ...
+func (s *Service) RevokeAPIKey(ctx context.Context, id int64) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE api_keys SET revoked = CURRENT_TIMESTAMP WHERE id = $1 AND revoked IS NULL`, id)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoSuchUser
+	}
+	return nil
+}
+
+// apiKeyRole is what the creator of a key has to stay for the key to keep working,
+// it is managers.RoleAdmin, which this package can't import
+const apiKeyRole = "ADMIN"
+
+//AuthenticateAPIKey returns the manager who created the key and the key scopes; a key
+//acts as its creator, so it stops working once they are deactivated or no longer ADMIN
+func (s *Service) AuthenticateAPIKey(ctx context.Context, key string, client *Client) (int64, []string, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return 0, nil, ErrInvalidToken
+	}
+	if client == nil {
+		client = &Client{}
+	}
+
+	var id int64
+	var scopes, allowlist []string
+	err := s.pool.QueryRow(ctx, `UPDATE api_keys k SET last_used = CURRENT_TIMESTAMP FROM managers m
+	WHERE k.key = $1 AND k.revoked IS NULL AND (k.expire IS NULL OR k.expire > CURRENT_TIMESTAMP)
+	AND m.id = k.manager_id AND m.active AND $2 = ANY(m.roles)
+	RETURNING k.manager_id, k.scopes, k.ip_allowlist`, HashToken(key), apiKeyRole).Scan(&id, &scopes, &allowlist)
+	if err == pgx.ErrNoRows {
+		return 0, nil, ErrInvalidToken
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return 0, nil, ErrInternal
+	}
+
+	if !allowed(allowlist, client.IP) {
+		return 0, nil, ErrAddressNotAllowed
+	}
+	return id, scopes, nil
+}
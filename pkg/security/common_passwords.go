@@ -0,0 +1,40 @@
+package security
+
+// commonPasswords is a local list of the most widespread leaked passwords,
+// compared lowercase; it is intentionally small and ships with the binary
+var commonPasswords = map[string]bool{
+	"123456": true, "123456789": true, "12345678": true, "password": true, "qwerty123": true, "qwerty": true,
+	"1234567890": true, "111111": true, "1234567": true, "123123": true, "12345": true, "1234": true,
+	"000000": true, "iloveyou": true, "abc123": true, "password1": true, "password123": true,
+	"qwertyuiop": true, "123321": true, "666666": true, "654321": true, "987654321": true, "555555": true,
+	"7777777": true, "888888": true, "11111111": true, "12341234": true, "00000000": true, "1q2w3e4r": true,
+	"1q2w3e4r5t": true, "1qaz2wsx": true, "qazwsx": true, "qazwsxedc": true, "zaq12wsx": true,
+	"asdfghjkl": true, "asdfgh": true, "zxcvbnm": true, "zxcvbnm1": true, "monkey": true, "dragon": true,
+	"letmein": true, "football": true, "baseball": true, "welcome": true, "welcome1": true, "admin": true,
+	"admin123": true, "administrator": true, "root": true, "toor": true, "master": true, "sunshine": true,
+	"princess": true, "shadow": true, "superman": true, "batman": true, "trustno1": true, "michael": true,
+	"jennifer": true, "hunter": true, "hunter2": true, "charlie": true, "jordan23": true, "freedom": true,
+	"whatever": true, "starwars": true, "passw0rd": true, "p@ssw0rd": true, "p@ssword": true, "pa$$word": true,
+	"123qwe": true, "123qweasd": true, "qwe123": true, "qweasd": true, "qweasdzxc": true, "1234qwer": true,
+	"q1w2e3r4": true, "q1w2e3r4t5": true, "a1b2c3d4": true, "aa123456": true, "abcd1234": true, "abcdef": true,
+	"abcdefg": true, "abcdefgh": true, "11223344": true, "112233": true, "121212": true, "131313": true,
+	"159753": true, "159357": true, "147258369": true, "147258": true, "789456123": true, "789456": true,
+	"741852963": true, "963852741": true, "246810": true, "987654": true, "5201314": true, "520520": true,
+	"999999": true, "99999999": true, "88888888": true, "77777777": true, "66666666": true, "55555555": true,
+	"44444444": true, "33333333": true, "22222222": true, "10203040": true, "1029384756": true,
+	"0987654321": true, "1111111111": true, "iloveyou1": true, "loveme": true, "lovely": true, "flower": true,
+	"football1": true, "soccer": true, "hockey": true, "killer": true, "ranger": true, "buster": true,
+	"thomas": true, "robert": true, "daniel": true, "andrew": true, "joshua": true, "matthew": true,
+	"maggie": true, "ginger": true, "pepper": true, "cookie": true, "summer": true, "winter": true,
+	"spring": true, "autumn": true, "secret": true, "secret1": true, "changeme": true, "changeme1": true,
+	"default": true, "guest": true, "test": true, "test123": true, "testtest": true, "temp1234": true,
+	"access": true, "access14": true, "login": true, "login123": true, "mustang": true, "harley": true,
+	"corvette": true, "ferrari": true, "porsche": true, "mercedes": true, "computer": true, "internet": true,
+	"samsung": true, "nokia": true, "iphone": true, "google": true, "yahoo": true, "facebook": true,
+	"vkontakte": true, "yandex": true, "odnoklassniki": true, "parol": true, "parol123": true, "privet": true,
+	"qwerty1": true, "qwerty12": true, "qwerty1234": true, "qwertyu": true, "ytrewq": true, "asdf1234": true,
+	"zxcv1234": true, "1qazxsw2": true, "!qaz2wsx": true, "1q2w3e": true, "1q2w3e4r5t6y": true,
+	"zaq1zaq1": true, "zaq1xsw2": true, "marina": true, "natasha": true, "tatiana": true, "svetlana": true,
+	"alexander": true, "alexandr": true, "dmitry": true, "sergey": true, "vladimir": true, "maxim": true,
+	"dushanbe": true, "tajikistan": true, "khujand": true, "somoni": true,
+}
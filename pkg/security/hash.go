@@ -0,0 +1,241 @@
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	//AlgorithmBcrypt ...
+	AlgorithmBcrypt = "bcrypt"
+	//AlgorithmArgon2id ...
+	AlgorithmArgon2id = "argon2id"
+)
+
+const (
+	argon2SaltSize = 16
+	argon2KeySize  = 32
+)
+
+// errUnknownHash is returned for stored values that aren't a hash this package produces
+var errUnknownHash = errors.New("unknown password hash format")
+
+//PasswordParams are the parameters new password hashes are made with,
+//hashes made with anything else are upgraded on the next successful login
+type PasswordParams struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // KiB
+	Argon2Threads uint8
+}
+
+//DefaultPasswordParams ...
+func DefaultPasswordParams() PasswordParams {
+	return PasswordParams{
+		Algorithm:     AlgorithmBcrypt,
+		BcryptCost:    bcrypt.DefaultCost,
+		Argon2Time:    3,
+		Argon2Memory:  64 * 1024,
+		Argon2Threads: 2,
+	}
+}
+
+//PasswordStats counts accounts of one kind by whether their hash follows the current parameters
+type PasswordStats struct {
+	Total    int64 `json:"total"`
+	Current  int64 `json:"current"`
+	Outdated int64 `json:"outdated"`
+}
+
+// hashDescriptor is the parameters part of an encoded hash, without salt and key
+type hashDescriptor struct {
+	algorithm string
+	cost      int
+	time      uint32
+	memory    uint32
+	threads   uint8
+}
+
+// parseHash reads the descriptor of "$2a$10$..." or "$argon2id$v=19$m=..,t=..,p=..$...",
+// the salt and key may be missing
+func parseHash(hash string) (*hashDescriptor, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, errUnknownHash
+	}
+	switch parts[1] {
+	case "2a", "2b", "2y":
+		cost, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, errUnknownHash
+		}
+		return &hashDescriptor{algorithm: AlgorithmBcrypt, cost: cost}, nil
+	case AlgorithmArgon2id:
+		if len(parts) < 4 || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+			return nil, errUnknownHash
+		}
+		d := &hashDescriptor{algorithm: AlgorithmArgon2id}
+		_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &d.memory, &d.time, &d.threads)
+		if err != nil {
+			return nil, errUnknownHash
+		}
+		return d, nil
+	}
+	return nil, errUnknownHash
+}
+
+// outdated tells whether a hash with this descriptor should be redone with p
+func (d *hashDescriptor) outdated(p PasswordParams) bool {
+	if d.algorithm != p.Algorithm {
+		return true
+	}
+	if d.algorithm == AlgorithmBcrypt {
+		return d.cost < p.BcryptCost
+	}
+	return d.time < p.Argon2Time || d.memory < p.Argon2Memory || d.threads < p.Argon2Threads
+}
+
+func (s *Service) passwordParams() PasswordParams {
+	if s.config == nil || s.config.Password.Algorithm == "" {
+		return DefaultPasswordParams()
+	}
+	return s.config.Password
+}
+
+//HashPassword hashes with the configured algorithm and parameters
+func (s *Service) HashPassword(ctx context.Context, password string) (string, error) {
+	p := s.passwordParams()
+	if p.Algorithm == AlgorithmArgon2id {
+		salt := make([]byte, argon2SaltSize)
+		n, err := rand.Read(salt)
+		if n != len(salt) || err != nil {
+			logging.FromContext(ctx).Println("argon2 salt:", err)
+			return "", ErrInternal
+		}
+		key := argon2.IDKey([]byte(password), salt, p.Argon2Time, p.Argon2Memory, p.Argon2Threads, argon2KeySize)
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			AlgorithmArgon2id, argon2.Version, p.Argon2Memory, p.Argon2Time, p.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), p.BcryptCost)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return "", ErrInternal
+	}
+	return string(hash), nil
+}
+
+// verifyPassword compares a password with a stored hash of either algorithm,
+// stale reports a match made with parameters below the current ones
+func (s *Service) verifyPassword(hash, password string) (ok bool, stale bool) {
+	d, err := parseHash(hash)
+	if err != nil {
+		return false, false
+	}
+
+	if d.algorithm == AlgorithmBcrypt {
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	} else {
+		parts := strings.Split(hash, "$")
+		if len(parts) != 6 {
+			return false, false
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+		if err != nil {
+			return false, false
+		}
+		key, err := base64.RawStdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return false, false
+		}
+		other := argon2.IDKey([]byte(password), salt, d.time, d.memory, d.threads, uint32(len(key)))
+		ok = subtle.ConstantTimeCompare(key, other) == 1
+	}
+
+	return ok, ok && d.outdated(s.passwordParams())
+}
+
+// rehash stores a hash with the current parameters after a successful login,
+// it only replaces the hash that was checked so a concurrent change wins
+func (s *Service) rehash(ctx context.Context, t tokensTable, id int64, oldHash, password string) {
+	hash, err := s.HashPassword(ctx, password)
+	if err != nil {
+		return
+	}
+	_, err = s.pool.Exec(ctx, `update `+t.users+` set password = $3 where id = $1 and password = $2`, id, oldHash, hash)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+	}
+}
+
+// hashPrefix is a postgres regexp cutting a stored hash down to its descriptor
+// so that rows can be grouped by parameters, plaintext leftovers give NULL
+const hashPrefix = `^\$[^$]+\$[^$]+\$(?:[^$]*=[^$]*\$)?`
+
+//PasswordStats reports how many customers and managers still have hashes made
+//with older parameters, keyed by account kind
+func (s *Service) PasswordStats(ctx context.Context) (map[string]*PasswordStats, error) {
+	stats := make(map[string]*PasswordStats)
+	for _, t := range []tokensTable{customersTokens, managersTokens} {
+		item, err := s.passwordStats(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		stats[t.kind] = item
+	}
+	return stats, nil
+}
+
+func (s *Service) passwordStats(ctx context.Context, t tokensTable) (*PasswordStats, error) {
+	sql := `select substring(password from $1), count(*) from ` + t.users + ` group by 1`
+	rows, err := s.pool.Query(ctx, sql, hashPrefix)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	params := s.passwordParams()
+	item := &PasswordStats{}
+	for rows.Next() {
+		var prefix *string
+		var count int64
+		err = rows.Scan(&prefix, &count)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+		item.Total += count
+		if prefix == nil {
+			item.Outdated += count
+			continue
+		}
+		d, err := parseHash(*prefix)
+		if err != nil || d.outdated(params) {
+			item.Outdated += count
+			continue
+		}
+		item.Current += count
+	}
+
+	err = rows.Err()
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	return item, nil
+}
@@ -0,0 +1,221 @@
+package security
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+)
+
+//Config ...
+type Config struct {
+	// Stateless switches access tokens to signed JWT (HS256) validated in-process
+	Stateless bool
+	// KeyID is the kid used to sign new tokens
+	KeyID string
+	// Keys holds every kid accepted for verification, old keys stay here while rotating
+	Keys map[string][]byte
+	// TwoFactorRoles lists manager roles that must log in with a TOTP code
+	TwoFactorRoles []string
+	// Password holds the hashing parameters, the zero value means DefaultPasswordParams
+	Password PasswordParams
+}
+
+//Claims ...
+type Claims struct {
+	Subject  string   `json:"sub"`
+	Kind     string   `json:"kind"`
+	Roles    []string `json:"roles,omitempty"`
+	IssuedAt int64    `json:"iat"`
+	Expire   int64    `json:"exp"`
+	ID       string   `json:"jti"`
+}
+
+const (
+	//KindManager ...
+	KindManager = "manager"
+	//KindCustomer ...
+	KindCustomer = "customer"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+// denylist keeps digests of revoked signed tokens until they expire on their own
+type denylist struct {
+	mu    sync.Mutex
+	items map[string]time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{items: make(map[string]time.Time)}
+}
+
+func (d *denylist) add(digest string, expire time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for k, v := range d.items {
+		if now.After(v) {
+			delete(d.items, k)
+		}
+	}
+	d.items[digest] = expire
+}
+
+func (d *denylist) has(digest string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.items[digest]
+	return ok
+}
+
+//Stateless ...
+func (s *Service) Stateless() bool {
+	return s.config != nil && s.config.Stateless
+}
+
+func (s *Service) sign(ctx context.Context, claims *Claims) (string, error) {
+	key, ok := s.config.Keys[s.config.KeyID]
+	if !ok {
+		logging.FromContext(ctx).Println("no signing key", s.config.KeyID)
+		return "", ErrInternal
+	}
+	header, err := json.Marshal(&jwtHeader{Alg: "HS256", Typ: "JWT", Kid: s.config.KeyID})
+	if err != nil {
+		return "", ErrInternal
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", ErrInternal
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *Service) verify(token string, kind string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	header := &jwtHeader{}
+	err = json.Unmarshal(rawHeader, header)
+	if err != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	key, ok := s.config.Keys[header.Kid]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidToken
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	err = json.Unmarshal(rawClaims, claims)
+	if err != nil || claims.Kind != kind {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() > claims.Expire {
+		return nil, ErrExpireToken
+	}
+	if s.denylist.has(HashToken(token)) {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// accessToken returns a signed token in stateless mode and a random one otherwise
+func (s *Service) accessToken(ctx context.Context, db queryRower, t tokensTable, id int64) (string, error) {
+	if !s.Stateless() {
+		return randomHex(256)
+	}
+
+	var roles []string
+	if t.kind == KindManager {
+		err := db.QueryRow(ctx, `select roles from managers where id = $1`, id).Scan(&roles)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return "", ErrInternal
+		}
+	}
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return s.sign(ctx, &Claims{
+		Subject:  strconv.FormatInt(id, 10),
+		Kind:     t.kind,
+		Roles:    roles,
+		IssuedAt: now.Unix(),
+		Expire:   now.Add(AccessTokenTTL).Unix(),
+		ID:       jti,
+	})
+}
+
+// claims validates a signed token in-process
+func (s *Service) claims(token string, kind string) (int64, []string, error) {
+	claims, err := s.verify(token, kind)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, nil, ErrInvalidToken
+	}
+	return id, claims.Roles, nil
+}
+
+//ManagerClaims ...
+func (s *Service) ManagerClaims(ctx context.Context, token string) (int64, []string, error) {
+	if !s.Stateless() {
+		id, err := s.AuthenticateManagers(ctx, token)
+		return id, nil, err
+	}
+	return s.claims(token, KindManager)
+}
+
+//CustomerClaims ...
+func (s *Service) CustomerClaims(ctx context.Context, token string) (int64, []string, error) {
+	if !s.Stateless() {
+		id, err := s.AuthenticateCustomer(ctx, token)
+		return id, nil, err
+	}
+	return s.claims(token, KindCustomer)
+}
+
+// deny puts revoked signed tokens on the denylist, no-op for opaque tokens;
+// a signed token can't outlive AccessTokenTTL so the entry is kept that long
+func (s *Service) deny(digest string) {
+	if !s.Stateless() {
+		return
+	}
+	s.denylist.add(digest, time.Now().Add(AccessTokenTTL))
+}
@@ -0,0 +1,219 @@
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/jackc/pgx/v4"
+)
+
+//ResetCodeTTL ...
+const ResetCodeTTL = 15 * time.Minute
+
+// maxResetAttempts is how many wrong codes a reset request survives
+const maxResetAttempts = 5
+
+//MaxResetRequests is how many codes a user gets per ResetRequestWindow, with
+//maxResetAttempts guesses each that bounds the guesses at a code per window
+const MaxResetRequests = 3
+
+//ResetRequestWindow ...
+const ResetRequestWindow = time.Hour
+
+//ErrInvalidCode ...
+var ErrInvalidCode = errors.New("invalid or expired code")
+
+//ChangeCustomerPassword ...
+func (s *Service) ChangeCustomerPassword(ctx context.Context, id int64, oldPassword, newPassword string) error {
+	return s.changePassword(ctx, customersTokens, id, oldPassword, newPassword)
+}
+
+//ChangeManagerPassword ...
+func (s *Service) ChangeManagerPassword(ctx context.Context, id int64, oldPassword, newPassword string) error {
+	return s.changePassword(ctx, managersTokens, id, oldPassword, newPassword)
+}
+
+//RequestCustomerReset ...
+func (s *Service) RequestCustomerReset(ctx context.Context, phone string) error {
+	return s.requestReset(ctx, customersTokens, phone)
+}
+
+//RequestManagerReset ...
+func (s *Service) RequestManagerReset(ctx context.Context, phone string) error {
+	return s.requestReset(ctx, managersTokens, phone)
+}
+
+//ResetCustomerPassword ...
+func (s *Service) ResetCustomerPassword(ctx context.Context, phone, code, newPassword string) error {
+	return s.resetPassword(ctx, customersTokens, phone, code, newPassword)
+}
+
+//ResetManagerPassword ...
+func (s *Service) ResetManagerPassword(ctx context.Context, phone, code, newPassword string) error {
+	return s.resetPassword(ctx, managersTokens, phone, code, newPassword)
+}
+
+func (s *Service) changePassword(ctx context.Context, t tokensTable, id int64, oldPassword, newPassword string) error {
+	var hash, phone string
+	err := s.pool.QueryRow(ctx, `select password, phone from `+t.users+` where id = $1 and `+t.live, id).Scan(&hash, &phone)
+	if err == pgx.ErrNoRows {
+		return ErrNoSuchUser
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+
+	if ok, _ := s.verifyPassword(hash, oldPassword); !ok {
+		return ErrInvalidPassword
+	}
+
+	err = ValidatePassword(newPassword, phone)
+	if err != nil {
+		return err
+	}
+
+	return s.setPassword(ctx, t, id, newPassword)
+}
+
+func (s *Service) setPassword(ctx context.Context, t tokensTable, id int64, password string) error {
+	hash, err := s.HashPassword(ctx, password)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `update `+t.users+` set password = $2 where id = $1`, id, hash)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+// requestReset sends a one-time code and spends the earlier ones; unknown phones and
+// users past MaxResetRequests are silently ignored so the answer doesn't tell whether
+// the phone is registered
+func (s *Service) requestReset(ctx context.Context, t tokensTable, phone string) (err error) {
+	phone = normalizePhone(phone)
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	defer func() {
+		if err != nil {
+			if errR := tx.Rollback(ctx); errR != nil {
+				logging.FromContext(ctx).Println(errR)
+			}
+			return
+		}
+		err = tx.Commit(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			err = ErrInternal
+		}
+	}()
+
+	// the row lock serializes concurrent requests of one user
+	var id int64
+	err = tx.QueryRow(ctx, `select id from `+t.users+` where phone = $1 and `+t.live+` for update`, phone).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+
+	var recent int
+	err = tx.QueryRow(ctx, `select count(*) from password_resets
+	where kind = $1 and user_id = $2 and created > CURRENT_TIMESTAMP - $3 * INTERVAL '1 second'`,
+		t.kind, id, int64(ResetRequestWindow/time.Second)).Scan(&recent)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	if recent >= MaxResetRequests {
+		logging.FromContext(ctx).Println("password reset requests exhausted for", t.kind, id)
+		return nil
+	}
+
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+
+	_, err = tx.Exec(ctx, `update password_resets set used = CURRENT_TIMESTAMP
+	where kind = $1 and user_id = $2 and used is null`, t.kind, id)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO password_resets (kind, user_id, code, expire)
+	VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 second')`,
+		t.kind, id, HashToken(code), int64(ResetCodeTTL/time.Second))
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+
+	err = s.notifier.Notify(ctx, phone, "password reset code: "+code)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+func (s *Service) resetPassword(ctx context.Context, t tokensTable, phone, code, newPassword string) error {
+	phone = normalizePhone(phone)
+	var id, resetID int64
+	var digest string
+	err := s.pool.QueryRow(ctx, `select u.id, r.id, r.code from `+t.users+` u
+	join password_resets r on r.kind = $1 and r.user_id = u.id
+	where u.phone = $2 and `+t.live+` and r.used is null and r.expire > CURRENT_TIMESTAMP and r.attempts < $3
+	order by r.id desc limit 1`, t.kind, phone, maxResetAttempts).Scan(&id, &resetID, &digest)
+	if err == pgx.ErrNoRows {
+		return ErrInvalidCode
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+
+	if digest != HashToken(code) {
+		_, err = s.pool.Exec(ctx, `update password_resets set attempts = attempts + 1 where id = $1`, resetID)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+		}
+		return ErrInvalidCode
+	}
+
+	// checked before the code is spent so that a rejected password can be retried
+	err = ValidatePassword(newPassword, phone)
+	if err != nil {
+		return err
+	}
+
+	tag, err := s.pool.Exec(ctx, `update password_resets set used = CURRENT_TIMESTAMP where id = $1 and used is null`, resetID)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidCode
+	}
+
+	err = s.setPassword(ctx, t, id, newPassword)
+	if err != nil {
+		return err
+	}
+	s.throttle.reset(phoneKey(t, phone))
+	return s.revokeTokens(ctx, t, id)
+}
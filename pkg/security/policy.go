@@ -0,0 +1,55 @@
+package security
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+//MinPasswordLength ...
+const MinPasswordLength = 8
+
+// password policy rules reported in ErrPasswordPolicy
+const (
+	RuleMinLength   = "min_length"
+	RuleCommon      = "common_password"
+	RuleEqualsPhone = "equals_phone"
+)
+
+//ErrPasswordPolicy lists every rule the password breaks
+type ErrPasswordPolicy struct {
+	Rules []string
+}
+
+func (e *ErrPasswordPolicy) Error() string {
+	return fmt.Sprintf("password violates policy: %s", strings.Join(e.Rules, ", "))
+}
+
+func digits(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, value)
+}
+
+//ValidatePassword checks a new password against the policy, phone is the account phone
+func ValidatePassword(password string, phone string) error {
+	var rules []string
+	if len([]rune(password)) < MinPasswordLength {
+		rules = append(rules, RuleMinLength)
+	}
+	if commonPasswords[strings.ToLower(password)] {
+		rules = append(rules, RuleCommon)
+	}
+	// the phone itself, or its local part typed as digits, is the first thing to try
+	if phone != "" && (password == phone ||
+		(password != "" && password == digits(password) && strings.HasSuffix(digits(phone), password))) {
+		rules = append(rules, RuleEqualsPhone)
+	}
+	if len(rules) != 0 {
+		return &ErrPasswordPolicy{Rules: rules}
+	}
+	return nil
+}
@@ -2,13 +2,12 @@ package security
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
-	"log"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/SsSJKK/crud/pkg/notify"
+	"github.com/SsSJKK/crud/pkg/phone"
 
 	"github.com/jackc/pgx/v4"
 
@@ -17,7 +16,12 @@ import (
 
 //Service ...
 type Service struct {
-	pool *pgxpool.Pool
+	pool      *pgxpool.Pool
+	config    *Config
+	denylist  *denylist
+	throttle  *throttle
+	notifier  notify.Notifier
+	dummyHash string
 }
 
 // ErrNoSuchUser ...
@@ -32,21 +36,52 @@ var ErrInternal = errors.New("internal error")
 // ErrExpireToken ...
 var ErrExpireToken = errors.New("ExpireToken error")
 
+// ErrInvalidToken ...
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrInvalidCredentials is returned for both unknown phone and wrong password
+var ErrInvalidCredentials = errors.New("invalid phone or password")
+
+// ErrBasicNotAllowed ...
+var ErrBasicNotAllowed = errors.New("basic auth not allowed for this account")
+
+// ErrTokenReuse ...
+var ErrTokenReuse = errors.New("refresh token reuse")
+
 //NewService ...
-func NewService(pool *pgxpool.Pool) *Service {
-	return &Service{pool: pool}
+func NewService(pool *pgxpool.Pool, config *Config, notifier notify.Notifier) *Service {
+	s := &Service{
+		pool:     pool,
+		config:   config,
+		denylist: newDenylist(),
+		throttle: newThrottle(),
+		notifier: notifier,
+	}
+	// compared against for unknown phones so that they take as long as wrong passwords
+	s.dummyHash, _ = s.HashPassword(context.Background(), "dummy password")
+	return s
+}
+
+//AuthCustomer checks Basic credentials of a customer
+func (s *Service) AuthCustomer(ctx context.Context, phone, password string, client *Client) (int64, error) {
+	return s.checkPassword(ctx, customersTokens, phone, password, client)
 }
 
-//Auth ...
-func (s *Service) Auth(login, password string) bool {
-	sql := `select login, password from managers where login=$1 and password=$2`
-	err := s.pool.QueryRow(context.Background(), sql, login, password).Scan(&login, &password)
-	log.Print(login, password)
+//AuthManager checks Basic credentials of a manager, managers who log in
+//with a second factor can't use Basic auth since it would bypass it
+func (s *Service) AuthManager(ctx context.Context, phone, password string, client *Client) (int64, error) {
+	id, err := s.checkPassword(ctx, managersTokens, phone, password, client)
 	if err != nil {
-		log.Print(err)
-		return false
+		return 0, err
 	}
-	return true
+	_, _, required, err := s.twoFactorState(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if required {
+		return 0, ErrBasicNotAllowed
+	}
+	return id, nil
 }
 
 //TokenForCustomer ...
@@ -54,47 +89,111 @@ func (s *Service) TokenForCustomer(
 	ctx context.Context,
 	phone string,
 	password string,
-) (token string, err error) {
+	client *Client,
+) (token *Token, err error) {
+	id, err := s.checkPassword(ctx, customersTokens, phone, password, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.insertToken(ctx, s.pool, customersTokens, id, "", client)
+}
+
+// checkPassword verifies login credentials with per-phone and per-address throttling,
+// every failure looks the same to the caller
+func (s *Service) checkPassword(
+	ctx context.Context,
+	t tokensTable,
+	phone string,
+	password string,
+	client *Client,
+) (int64, error) {
+	if client == nil {
+		client = &Client{}
+	}
+	phone = normalizePhone(phone)
+	userKey := phoneKey(t, phone)
+	addrKey := ipKey(client.IP)
+	if wait := s.throttle.wait(userKey, addrKey); wait > 0 {
+		return 0, &ErrTooManyAttempts{RetryAfter: wait}
+	}
+
 	var hash string
 	var id int64
-	sql := `Select id, password FROM customers where phone = $1`
-	err = s.pool.QueryRow(ctx, sql, phone).Scan(&id, &hash)
-
-	if err == pgx.ErrNoRows {
-		return "", ErrNoSuchUser
+	sql := `Select id, password FROM ` + t.users + ` where phone = $1 and ` + t.enabled
+	err := s.pool.QueryRow(ctx, sql, phone).Scan(&id, &hash)
+	if err != nil && err != pgx.ErrNoRows {
+		logging.FromContext(ctx).Println(err)
+		return 0, ErrInternal
 	}
-	if err != nil {
-		return "", ErrInternal
+	found := err == nil
+	if !found {
+		hash = s.dummyHash
+	}
+	ok, stale := s.verifyPassword(hash, password)
+	if !found || !ok {
+		s.throttle.fail(userKey, MaxLoginFailures)
+		s.throttle.failWindow(addrKey, MaxIPLoginFailures)
+		return 0, ErrInvalidCredentials
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	if err != nil {
-		return "", ErrInvalidPassword
+	s.throttle.reset(userKey)
+	if stale {
+		s.rehash(ctx, t, id, hash, password)
 	}
+	return id, nil
+}
+
+// normalizePhone brings a login to the E.164 form phones are stored in, numbers that
+// don't parse are left alone and simply match nobody
+func normalizePhone(number string) string {
+	if normalized, err := phone.Normalize(number); err == nil {
+		return normalized
+	}
+	return number
+}
+
+//UnlockCustomer ...
+func (s *Service) UnlockCustomer(ctx context.Context, id int64) error {
+	return s.unlock(ctx, customersTokens, id)
+}
 
-	buffer := make([]byte, 256)
-	n, err := rand.Read(buffer)
-	if n != len(buffer) || err != nil {
-		return "", ErrInternal
+//UnlockManager ...
+func (s *Service) UnlockManager(ctx context.Context, id int64) error {
+	return s.unlock(ctx, managersTokens, id)
+}
+
+func (s *Service) unlock(ctx context.Context, t tokensTable, id int64) error {
+	var phone string
+	err := s.pool.QueryRow(ctx, `select phone from `+t.users+` where id = $1 and `+t.live, id).Scan(&phone)
+	if err == pgx.ErrNoRows {
+		return ErrNoSuchUser
 	}
-	token = hex.EncodeToString(buffer)
-	sqlInsert := `INSERT INTO customers_tokens (token, customer_id) VALUES ($1, $2)`
-	a, err := s.pool.Exec(ctx, sqlInsert, token, id)
-	log.Print(a)
-	return token, nil
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	s.throttle.reset(phoneKey(t, phone))
+	return nil
 }
 
 //AuthenticateCustomer ...
 func (s *Service) AuthenticateCustomer(ctx context.Context, tkn string) (int64, error) {
+	if s.Stateless() {
+		id, _, err := s.claims(tkn, KindCustomer)
+		return id, err
+	}
+
 	var id int64
 	var expire time.Time
-	err := s.pool.QueryRow(ctx, `select customer_id, expire from customers_tokens where token=$1`, tkn).Scan(&id, &expire)
+	err := s.pool.QueryRow(ctx, `update customers_tokens set last_used = CURRENT_TIMESTAMP
+	where token=$1 and revoked is null and customer_id in (select id from customers where `+customersTokens.enabled+`)
+	returning customer_id, expire`, HashToken(tkn)).Scan(&id, &expire)
 	if err == pgx.ErrNoRows {
-		log.Println("1")
-		return 0, ErrNoSuchUser
+		return 0, ErrInvalidToken
 	}
 	if err != nil {
-		log.Println("2")
+		logging.FromContext(ctx).Println(err)
 		return 0, ErrInternal
 	}
 
@@ -108,52 +207,46 @@ func (s *Service) AuthenticateCustomer(ctx context.Context, tkn string) (int64,
 	return id, nil
 }
 
-//TokenForManagers ...
+//TokenForManager ...
 func (s *Service) TokenForManager(
 	ctx context.Context,
 	phone string,
 	password string,
-) (token string, err error) {
-	var hash string
-	var id int64
-	sql := `Select id, password FROM managers where phone = $1`
-	err = s.pool.QueryRow(ctx, sql, phone).Scan(&id, &hash)
-
-	if err == pgx.ErrNoRows {
-		return "", ErrNoSuchUser
-	}
+	client *Client,
+) (token *Token, err error) {
+	id, err := s.checkPassword(ctx, managersTokens, phone, password, client)
 	if err != nil {
-		return "", ErrInternal
+		return nil, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	challenge, err := s.managerChallenge(ctx, id)
 	if err != nil {
-		return "", ErrInvalidPassword
+		return nil, err
 	}
-
-	buffer := make([]byte, 256)
-	n, err := rand.Read(buffer)
-	if n != len(buffer) || err != nil {
-		return "", ErrInternal
+	if challenge != nil {
+		return nil, &ErrTwoFactorRequired{Challenge: challenge}
 	}
-	token = hex.EncodeToString(buffer)
-	sqlInsert := `INSERT INTO managers_tokens (token, manager_id) VALUES ($1, $2)`
-	a, err := s.pool.Exec(ctx, sqlInsert, token, id)
-	log.Print(a)
-	return token, nil
+
+	return s.insertToken(ctx, s.pool, managersTokens, id, "", client)
 }
 
-//AuthenticateCustomer ...
+//AuthenticateManagers ...
 func (s *Service) AuthenticateManagers(ctx context.Context, tkn string) (int64, error) {
+	if s.Stateless() {
+		id, _, err := s.claims(tkn, KindManager)
+		return id, err
+	}
+
 	var id int64
 	var expire time.Time
-	err := s.pool.QueryRow(ctx, `select manager_id, expire from managers_tokens where token=$1`, tkn).Scan(&id, &expire)
+	err := s.pool.QueryRow(ctx, `update managers_tokens set last_used = CURRENT_TIMESTAMP
+	where token=$1 and revoked is null and manager_id in (select id from managers where `+managersTokens.enabled+`)
+	returning manager_id, expire`, HashToken(tkn)).Scan(&id, &expire)
 	if err == pgx.ErrNoRows {
-		log.Println("1")
-		return 0, ErrNoSuchUser
+		return 0, ErrInvalidToken
 	}
 	if err != nil {
-		log.Println("2")
+		logging.FromContext(ctx).Println(err)
 		return 0, ErrInternal
 	}
 
@@ -167,18 +260,7 @@ func (s *Service) AuthenticateManagers(ctx context.Context, tkn string) (int64,
 	return id, nil
 }
 
-func (s *Service) TokenWithOut(ctx context.Context, id int64) (string, error) {
-	buffer := make([]byte, 256)
-	n, err := rand.Read(buffer)
-	if n != len(buffer) || err != nil {
-		return "", err
-	}
-	token := hex.EncodeToString(buffer)
-	sqlInsert := `INSERT INTO managers_tokens (token, manager_id) VALUES ($1, $2)`
-	a, err := s.pool.Exec(ctx, sqlInsert, token, id)
-	if err != nil {
-		log.Println(a, err)
-		return "", err
-	}
-	return token, nil
+//TokenWithOut ...
+func (s *Service) TokenWithOut(ctx context.Context, id int64, client *Client) (*Token, error) {
+	return s.insertToken(ctx, s.pool, managersTokens, id, "", client)
 }
@@ -0,0 +1,144 @@
+package security
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//MaxLoginFailures locks a phone number after that many failures in a row
+const MaxLoginFailures = 5
+
+//MaxIPLoginFailures locks a client address after that many failures within LockoutDuration;
+//addresses get no backoff before that, many users may share one behind NAT
+const MaxIPLoginFailures = 50
+
+//LockoutDuration ...
+const LockoutDuration = 15 * time.Minute
+
+// loginBackoff is the delay after the first failure, doubled for every next one
+const loginBackoff = time.Second
+
+// sweepEvery is how many counted failures pass between dropping stale entries
+const sweepEvery = 1024
+
+//ErrTooManyAttempts ...
+type ErrTooManyAttempts struct {
+	RetryAfter time.Duration
+}
+
+func (e *ErrTooManyAttempts) Error() string {
+	return fmt.Sprintf("too many login attempts, retry after %s", e.RetryAfter)
+}
+
+type attempts struct {
+	failures int
+	first    time.Time
+	last     time.Time
+	next     time.Time
+}
+
+// throttle counts failed logins per key (phone or client address) in memory
+type throttle struct {
+	mu    sync.Mutex
+	items map[string]*attempts
+	calls int
+}
+
+func newThrottle() *throttle {
+	return &throttle{items: make(map[string]*attempts)}
+}
+
+func phoneKey(t tokensTable, phone string) string {
+	return t.kind + ":" + phone
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// wait returns how long the caller must wait before the next attempt for any of keys
+func (t *throttle) wait(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		item, ok := t.items[key]
+		if !ok {
+			continue
+		}
+		if d := item.next.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// fail counts a failure for key and delays the next attempt, doubling the delay
+// with every failure in a row up to a lockout at limit
+func (t *throttle) fail(key string, limit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	item := t.item(key, now)
+	item.failures++
+	item.last = now
+	if item.failures >= limit {
+		item.next = now.Add(LockoutDuration)
+		return
+	}
+	backoff := loginBackoff << uint(item.failures-1)
+	if backoff > LockoutDuration {
+		backoff = LockoutDuration
+	}
+	item.next = now.Add(backoff)
+}
+
+// failWindow counts a failure for key without any delay until limit failures
+// fall within one LockoutDuration window, then locks the key out
+func (t *throttle) failWindow(key string, limit int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	item := t.item(key, now)
+	if now.Sub(item.first) > LockoutDuration {
+		item.failures, item.first = 0, now
+	}
+	item.failures++
+	item.last = now
+	if item.failures >= limit {
+		item.next = now.Add(LockoutDuration)
+	}
+}
+
+// item returns the attempts of key, starting over when they are stale; every sweepEvery
+// calls it drops all stale entries; t.mu must be held
+func (t *throttle) item(key string, now time.Time) *attempts {
+	t.calls++
+	if t.calls%sweepEvery == 0 {
+		for k, v := range t.items {
+			if v.stale(now) {
+				delete(t.items, k)
+			}
+		}
+	}
+
+	item, ok := t.items[key]
+	if !ok || item.stale(now) {
+		item = &attempts{first: now}
+		t.items[key] = item
+	}
+	return item
+}
+
+// stale tells whether the attempts no longer delay anything and are too old to count
+func (a *attempts) stale(now time.Time) bool {
+	return now.Sub(a.last) > LockoutDuration && now.After(a.next)
+}
+
+func (t *throttle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.items, key)
+}
@@ -0,0 +1,54 @@
+package security
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestThrottleBackoff(t *testing.T) {
+	th := newThrottle()
+	for i := 1; i < MaxLoginFailures; i++ {
+		th.fail("customer:+992927776655", MaxLoginFailures)
+		want := loginBackoff << uint(i-1)
+		if wait := th.wait("customer:+992927776655", "ip:10.0.0.1"); wait > want || wait < want-time.Second {
+			t.Fatalf("after %d failures wait %s, want about %s", i, wait, want)
+		}
+	}
+	th.fail("customer:+992927776655", MaxLoginFailures)
+	if wait := th.wait("customer:+992927776655"); wait < LockoutDuration-time.Second {
+		t.Fatalf("after %d failures wait %s, want a lockout", MaxLoginFailures, wait)
+	}
+	th.reset("customer:+992927776655")
+	if wait := th.wait("customer:+992927776655"); wait != 0 {
+		t.Fatalf("after reset wait %s", wait)
+	}
+}
+
+func TestThrottleStale(t *testing.T) {
+	th := newThrottle()
+	old := time.Now().Add(-2 * LockoutDuration)
+	th.items["ip:10.0.0.1"] = &attempts{failures: MaxIPLoginFailures - 1, first: old, last: old, next: old}
+	th.items["ip:10.0.0.2"] = &attempts{failures: 3, first: old, last: old, next: old}
+
+	// a stale entry starts over when its key fails again
+	th.fail("ip:10.0.0.1", MaxLoginFailures)
+	if item := th.items["ip:10.0.0.1"]; item.failures != 1 {
+		t.Fatalf("stale entry kept %d failures", item.failures)
+	}
+
+	// other stale entries stay until the sweep
+	for i := 1; i < sweepEvery-1; i++ {
+		th.failWindow("ip:10.0.1."+strconv.Itoa(i%200), MaxIPLoginFailures)
+	}
+	if _, ok := th.items["ip:10.0.0.2"]; !ok {
+		t.Fatal("stale entry dropped before the sweep")
+	}
+	th.failWindow("ip:10.0.0.3", MaxIPLoginFailures)
+	if _, ok := th.items["ip:10.0.0.2"]; ok {
+		t.Fatal("stale entry kept after the sweep")
+	}
+	if _, ok := th.items["ip:10.0.0.3"]; !ok {
+		t.Fatal("fresh entry dropped by the sweep")
+	}
+}
@@ -0,0 +1,325 @@
+package security
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/jackc/pgx/v4"
+)
+
+//AccessTokenTTL ...
+const AccessTokenTTL = 15 * time.Minute
+
+//RefreshTokenTTL ...
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+//Client ...
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+//Token ...
+type Token struct {
+	Token         string    `json:"token"`
+	Expire        time.Time `json:"expire"`
+	RefreshToken  string    `json:"refresh_token"`
+	RefreshExpire time.Time `json:"refresh_expire"`
+}
+
+//Session ...
+type Session struct {
+	ID        int64      `json:"id"`
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"last_used"`
+	Expire    time.Time  `json:"expire"`
+	UserAgent string     `json:"user_agent"`
+	IP        string     `json:"ip"`
+	Current   bool       `json:"current"`
+}
+
+type tokensTable struct {
+	table  string
+	column string
+	kind   string
+	users  string
+	// live leaves deleted users out of lookups
+	live string
+	// enabled also leaves out users who may not log in, such as blocked customers
+	enabled string
+}
+
+var customersTokens = tokensTable{
+	table:   "customers_tokens",
+	column:  "customer_id",
+	kind:    KindCustomer,
+	users:   "customers",
+	live:    "deleted IS NULL",
+	enabled: "deleted IS NULL AND active",
+}
+
+var managersTokens = tokensTable{
+	table:   "managers_tokens",
+	column:  "manager_id",
+	kind:    KindManager,
+	users:   "managers",
+	live:    "TRUE",
+	enabled: "active",
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+//HashToken returns the digest under which a bearer token is stored
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(size int) (string, error) {
+	buffer := make([]byte, size)
+	n, err := rand.Read(buffer)
+	if n != len(buffer) || err != nil {
+		return "", ErrInternal
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// insertToken issues an access/refresh pair, family is empty for a new login
+func (s *Service) insertToken(
+	ctx context.Context,
+	db queryRower,
+	t tokensTable,
+	id int64,
+	family string,
+	client *Client,
+) (*Token, error) {
+	if client == nil {
+		client = &Client{}
+	}
+	var err error
+	if family == "" {
+		family, err = randomHex(16)
+		if err != nil {
+			return nil, err
+		}
+	}
+	token := &Token{}
+	token.Token, err = s.accessToken(ctx, db, t, id)
+	if err != nil {
+		return nil, err
+	}
+	token.RefreshToken, err = randomHex(256)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlInsert := `INSERT INTO ` + t.table + ` (token, ` + t.column + `, expire, refresh, refresh_expire, family, user_agent, ip)
+	VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second', $4, CURRENT_TIMESTAMP + $5 * INTERVAL '1 second', $6, $7, $8)
+	RETURNING expire, refresh_expire`
+	err = db.QueryRow(ctx, sqlInsert,
+		HashToken(token.Token),
+		id,
+		int64(AccessTokenTTL/time.Second),
+		HashToken(token.RefreshToken),
+		int64(RefreshTokenTTL/time.Second),
+		family,
+		client.UserAgent,
+		client.IP,
+	).Scan(&token.Expire, &token.RefreshExpire)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	return token, nil
+}
+
+//RefreshCustomerToken ...
+func (s *Service) RefreshCustomerToken(ctx context.Context, refresh string, client *Client) (*Token, error) {
+	return s.refreshToken(ctx, customersTokens, refresh, client)
+}
+
+//RefreshManagerToken ...
+func (s *Service) RefreshManagerToken(ctx context.Context, refresh string, client *Client) (*Token, error) {
+	return s.refreshToken(ctx, managersTokens, refresh, client)
+}
+
+// refreshToken spends a refresh token and issues the next pair of the same family,
+// replaying a spent refresh token revokes the whole family
+func (s *Service) refreshToken(ctx context.Context, t tokensTable, refresh string, client *Client) (token *Token, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err != nil && !errors.Is(err, ErrTokenReuse) {
+			if errR := tx.Rollback(ctx); errR != nil {
+				logging.FromContext(ctx).Println(errR)
+			}
+			return
+		}
+		if errC := tx.Commit(ctx); errC != nil {
+			logging.FromContext(ctx).Println(errC)
+			token, err = nil, ErrInternal
+		}
+	}()
+
+	var id, owner int64
+	var family string
+	var expired, enabled bool
+	var refreshed, revoked *time.Time
+	sqlSelect := `SELECT id, ` + t.column + `, family, refresh_expire < CURRENT_TIMESTAMP, refreshed, revoked,
+	` + t.column + ` IN (SELECT id FROM ` + t.users + ` WHERE ` + t.enabled + `) FROM ` + t.table + `
+	WHERE refresh = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, sqlSelect, HashToken(refresh)).Scan(&id, &owner, &family, &expired, &refreshed, &revoked, &enabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+
+	if refreshed != nil {
+		sqlRevoke := `UPDATE ` + t.table + ` SET revoked = CURRENT_TIMESTAMP WHERE family = $1 AND revoked IS NULL
+		RETURNING token`
+		rows, err := tx.Query(ctx, sqlRevoke, family)
+		err = s.denyRows(ctx, rows, err)
+		if err != nil {
+			return nil, err
+		}
+		logging.FromContext(ctx).Printf("refresh token reuse detected in %s family %s", t.table, family)
+		return nil, ErrTokenReuse
+	}
+	if revoked != nil || !enabled {
+		return nil, ErrInvalidToken
+	}
+	if expired {
+		return nil, ErrExpireToken
+	}
+
+	sqlSpend := `UPDATE ` + t.table + ` SET refreshed = CURRENT_TIMESTAMP, revoked = CURRENT_TIMESTAMP WHERE id = $1
+	RETURNING token`
+	rows, err := tx.Query(ctx, sqlSpend, id)
+	err = s.denyRows(ctx, rows, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.insertToken(ctx, tx, t, owner, family, client)
+}
+
+//RevokeCustomerToken ...
+func (s *Service) RevokeCustomerToken(ctx context.Context, token string) error {
+	return s.revokeToken(ctx, customersTokens, token)
+}
+
+//RevokeManagerToken ...
+func (s *Service) RevokeManagerToken(ctx context.Context, token string) error {
+	return s.revokeToken(ctx, managersTokens, token)
+}
+
+//RevokeCustomerTokens ...
+func (s *Service) RevokeCustomerTokens(ctx context.Context, id int64) error {
+	return s.revokeTokens(ctx, customersTokens, id)
+}
+
+//RevokeManagerTokens ...
+func (s *Service) RevokeManagerTokens(ctx context.Context, id int64) error {
+	return s.revokeTokens(ctx, managersTokens, id)
+}
+
+//CustomerSessions ...
+func (s *Service) CustomerSessions(ctx context.Context, id int64, current string) ([]*Session, error) {
+	return s.sessions(ctx, customersTokens, id, current)
+}
+
+//ManagerSessions ...
+func (s *Service) ManagerSessions(ctx context.Context, id int64, current string) ([]*Session, error) {
+	return s.sessions(ctx, managersTokens, id, current)
+}
+
+func (s *Service) revokeToken(ctx context.Context, t tokensTable, token string) error {
+	sqlUpdate := `UPDATE ` + t.table + ` SET revoked = CURRENT_TIMESTAMP WHERE token = $1 AND revoked IS NULL`
+	tag, err := s.pool.Exec(ctx, sqlUpdate, HashToken(token))
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidToken
+	}
+	s.deny(HashToken(token))
+	return nil
+}
+
+func (s *Service) revokeTokens(ctx context.Context, t tokensTable, id int64) error {
+	sqlUpdate := `UPDATE ` + t.table + ` SET revoked = CURRENT_TIMESTAMP WHERE ` + t.column + ` = $1 AND revoked IS NULL
+	RETURNING token`
+	rows, err := s.pool.Query(ctx, sqlUpdate, id)
+	return s.denyRows(ctx, rows, err)
+}
+
+// denyRows drains the RETURNING token result of a query and denylists every digest in it
+func (s *Service) denyRows(ctx context.Context, rows pgx.Rows, err error) error {
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var digest string
+		err = rows.Scan(&digest)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return ErrInternal
+		}
+		s.deny(digest)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return ErrInternal
+	}
+	return nil
+}
+
+func (s *Service) sessions(ctx context.Context, t tokensTable, id int64, current string) ([]*Session, error) {
+	items := make([]*Session, 0)
+	sqlSelect := `SELECT id, created, last_used, expire, user_agent, ip, token = $2 FROM ` + t.table + `
+	WHERE ` + t.column + ` = $1 AND revoked IS NULL AND refresh_expire > CURRENT_TIMESTAMP
+	ORDER BY created DESC`
+	rows, err := s.pool.Query(ctx, sqlSelect, id, HashToken(current))
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := &Session{}
+		err = rows.Scan(&item.ID, &item.Created, &item.LastUsed, &item.Expire, &item.UserAgent, &item.IP, &item.Current)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+		items = append(items, item)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+
+	return items, nil
+}
@@ -0,0 +1,366 @@
+package security
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SsSJKK/crud/pkg/logging"
+	"github.com/jackc/pgx/v4"
+)
+
+// RFC 6238 parameters, the defaults every authenticator app understands
+const (
+	totpStep   = 30
+	totpDigits = 6
+	totpModulo = 1000000
+	totpSkew   = 1
+)
+
+//TOTPIssuer is shown by authenticator apps next to the account
+const TOTPIssuer = "crud"
+
+//ChallengeTTL ...
+const ChallengeTTL = 5 * time.Minute
+
+// maxChallengeAttempts is how many wrong codes a login challenge survives
+const maxChallengeAttempts = 5
+
+// recoveryCodesCount is how many recovery codes are issued on enrollment
+const recoveryCodesCount = 10
+
+//ErrInvalidTOTP ...
+var ErrInvalidTOTP = errors.New("invalid two-factor code")
+
+//ErrTOTPEnabled ...
+var ErrTOTPEnabled = errors.New("two-factor authentication already enabled")
+
+//Enrollment ...
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+//Challenge ...
+type Challenge struct {
+	Challenge  string      `json:"challenge"`
+	Expire     time.Time   `json:"expire"`
+	Enrollment *Enrollment `json:"enrollment,omitempty"`
+}
+
+//ErrTwoFactorRequired is returned instead of a token when the login must be completed with a code
+type ErrTwoFactorRequired struct {
+	Challenge *Challenge
+}
+
+func (e *ErrTwoFactorRequired) Error() string {
+	return "two-factor authentication required"
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
+
+// validTOTP returns the matched time step, or 0 if code doesn't match
+// any step within the allowed skew or was already used (step <= lastStep)
+func validTOTP(secret string, code string, lastStep int64) int64 {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return 0
+	}
+	now := time.Now().Unix() / totpStep
+	for i := -totpSkew; i <= totpSkew; i++ {
+		step := now + int64(i)
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+func newTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", ErrInternal
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(key), nil
+}
+
+func newEnrollment(phone string, secret string) *Enrollment {
+	label := url.PathEscape(TOTPIssuer + ":" + phone)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", TOTPIssuer)
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpStep))
+	return &Enrollment{
+		Secret: secret,
+		URI:    "otpauth://totp/" + label + "?" + query.Encode(),
+	}
+}
+
+// twoFactorRequired tells whether any of roles is configured to require TOTP
+func (s *Service) twoFactorRequired(roles []string) bool {
+	if s.config == nil {
+		return false
+	}
+	for _, role := range roles {
+		for _, required := range s.config.TwoFactorRoles {
+			if role == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// twoFactorState tells whether a manager must pass a second factor,
+// either because TOTP is enabled or because the role requires it
+func (s *Service) twoFactorState(ctx context.Context, id int64) (phone string, enabled, required bool, err error) {
+	var roles []string
+	err = s.pool.QueryRow(ctx, `select phone, roles, totp_enabled from managers where id = $1`, id).
+		Scan(&phone, &roles, &enabled)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return "", false, false, ErrInternal
+	}
+	return phone, enabled, enabled || s.twoFactorRequired(roles), nil
+}
+
+// managerChallenge decides whether a manager who passed the password check needs
+// a second step, and if so stores a challenge; enrollment is started for managers
+// whose role requires TOTP but who have not set it up yet, a pending secret is
+// reused so that repeating the password step doesn't replace it
+func (s *Service) managerChallenge(ctx context.Context, id int64) (*Challenge, error) {
+	phone, enabled, required, err := s.twoFactorState(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !required {
+		return nil, nil
+	}
+
+	challenge := &Challenge{}
+	if !enabled {
+		secret, err := newTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		err = s.pool.QueryRow(ctx, `update managers set totp_secret = coalesce(totp_secret, $2)
+		where id = $1 returning totp_secret`, id, secret).Scan(&secret)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+		challenge.Enrollment = newEnrollment(phone, secret)
+	}
+
+	challenge.Challenge, err = randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	err = s.pool.QueryRow(ctx, `INSERT INTO managers_challenges (challenge, manager_id, expire)
+	VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 second') RETURNING expire`,
+		HashToken(challenge.Challenge), id, int64(ChallengeTTL/time.Second)).Scan(&challenge.Expire)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	return challenge, nil
+}
+
+//CompleteManagerChallenge finishes a two-step login with a TOTP or recovery code,
+//recovery codes are returned when the challenge also completed enrollment
+func (s *Service) CompleteManagerChallenge(
+	ctx context.Context,
+	challenge string,
+	code string,
+	client *Client,
+) (*Token, []string, error) {
+	var challengeID, id int64
+	err := s.pool.QueryRow(ctx, `UPDATE managers_challenges SET attempts = attempts + 1
+	WHERE challenge = $1 AND used IS NULL AND expire > CURRENT_TIMESTAMP AND attempts < $2
+	RETURNING id, manager_id`, HashToken(challenge), maxChallengeAttempts).Scan(&challengeID, &id)
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrInvalidToken
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, nil, ErrInternal
+	}
+
+	enabled, err := s.verifyManagerCode(ctx, id, code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tag, err := s.pool.Exec(ctx, `UPDATE managers_challenges SET used = CURRENT_TIMESTAMP
+	WHERE id = $1 AND used IS NULL`, challengeID)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, nil, ErrInternal
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, nil, ErrInvalidToken
+	}
+
+	var recovery []string
+	if !enabled {
+		recovery, err = s.enableTOTP(ctx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	token, err := s.insertToken(ctx, s.pool, managersTokens, id, "", client)
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, recovery, nil
+}
+
+// verifyManagerCode accepts a TOTP code or, once enrolled, an unused recovery code;
+// it reports whether TOTP was already enabled
+func (s *Service) verifyManagerCode(ctx context.Context, id int64, code string) (bool, error) {
+	var secret *string
+	var enabled bool
+	var lastStep int64
+	err := s.pool.QueryRow(ctx, `select totp_secret, totp_enabled, totp_last_step from managers where id = $1`, id).
+		Scan(&secret, &enabled, &lastStep)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return false, ErrInternal
+	}
+	if secret == nil {
+		return false, ErrInvalidTOTP
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if step := validTOTP(*secret, code, lastStep); step != 0 {
+		tag, err := s.pool.Exec(ctx, `update managers set totp_last_step = $2 where id = $1 and totp_last_step < $2`, id, step)
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return false, ErrInternal
+		}
+		if tag.RowsAffected() == 0 {
+			return false, ErrInvalidTOTP
+		}
+		return enabled, nil
+	}
+
+	if !enabled {
+		return false, ErrInvalidTOTP
+	}
+	tag, err := s.pool.Exec(ctx, `UPDATE managers_recovery_codes SET used = CURRENT_TIMESTAMP
+	WHERE manager_id = $1 AND code = $2 AND used IS NULL`, id, HashToken(code))
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return false, ErrInternal
+	}
+	if tag.RowsAffected() == 0 {
+		return false, ErrInvalidTOTP
+	}
+	return enabled, nil
+}
+
+// enableTOTP turns TOTP on and replaces recovery codes, which are returned once
+func (s *Service) enableTOTP(ctx context.Context, id int64) (codes []string, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	defer func() {
+		if err != nil {
+			if errR := tx.Rollback(ctx); errR != nil {
+				logging.FromContext(ctx).Println(errR)
+			}
+			return
+		}
+		err = tx.Commit(ctx)
+	}()
+
+	_, err = tx.Exec(ctx, `update managers set totp_enabled = true where id = $1`, id)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	_, err = tx.Exec(ctx, `delete from managers_recovery_codes where manager_id = $1`, id)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(ctx, `insert into managers_recovery_codes (manager_id, code) values ($1, $2)`, id, HashToken(code))
+		if err != nil {
+			logging.FromContext(ctx).Println(err)
+			return nil, ErrInternal
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+//EnrollManagerTOTP starts enrollment for an authenticated manager
+func (s *Service) EnrollManagerTOTP(ctx context.Context, id int64) (*Enrollment, error) {
+	var phone string
+	var enabled bool
+	err := s.pool.QueryRow(ctx, `select phone, totp_enabled from managers where id = $1`, id).Scan(&phone, &enabled)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNoSuchUser
+	}
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	enrollment := newEnrollment(phone, secret)
+	_, err = s.pool.Exec(ctx, `update managers set totp_secret = $2 where id = $1`, id, enrollment.Secret)
+	if err != nil {
+		logging.FromContext(ctx).Println(err)
+		return nil, ErrInternal
+	}
+	return enrollment, nil
+}
+
+//ConfirmManagerTOTP finishes enrollment and returns recovery codes
+func (s *Service) ConfirmManagerTOTP(ctx context.Context, id int64, code string) ([]string, error) {
+	enabled, err := s.verifyManagerCode(ctx, id, code)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+	return s.enableTOTP(ctx, id)
+}
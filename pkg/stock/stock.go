@@ -0,0 +1,21 @@
+package stock
+
+import "fmt"
+
+//ErrInsufficientStock is returned by sales and purchases that want more of a product than there is
+type ErrInsufficientStock struct {
+	ProductIDs []int64
+}
+
+func (e *ErrInsufficientStock) Error() string {
+	return fmt.Sprintf("insufficient stock for products %v", e.ProductIDs)
+}
+
+//ErrUnknownProducts is returned by sales and purchases of products that do not exist
+type ErrUnknownProducts struct {
+	ProductIDs []int64
+}
+
+func (e *ErrUnknownProducts) Error() string {
+	return fmt.Sprintf("unknown products %v", e.ProductIDs)
+}